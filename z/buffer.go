@@ -17,12 +17,22 @@
 package z
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
@@ -31,9 +41,176 @@ import (
 const (
 	defaultCapacity = 64
 	defaultTag      = "buffer"
+
+	// convertChunkSize is the number of bytes copied between progress reports and cancellation
+	// checks in ConvertToCtx.
+	convertChunkSize = 4 << 20
+
+	// Reallocations which happen within growBurstWindow of each other, to fit fewer bytes than the
+	// current capacity, are considered a burst. After growBurstLen of those, the growth factor is
+	// doubled, up to maxGrowFactor. Buffers with a max size always grow by a factor of 1.
+	growBurstWindow = 100 * time.Millisecond
+	growBurstLen    = 3
+	maxGrowFactor   = 8
+
+	// writeChunkSize is the max number of bytes passed to a single Write call when streaming the
+	// buffer to an io.Writer.
+	writeChunkSize = 1 << 20
+	// readChunkSize is the least number of bytes ReadFrom makes room for before every Read call.
+	readChunkSize = 64 << 10
+
+	// stringPreviewLen is the max number of written bytes shown by String.
+	stringPreviewLen = 32
+
+	// crcSize is the size of the CRC trailer written by SliceAllocateWithCRC.
+	crcSize = 4
+	// timestampSize is the size of the timestamp written by SliceAllocate with WithTimestamps.
+	timestampSize = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// tombstonePrefix starts the slices written by WriteTombstone. Regular slices must not start with
+// it. The NUL bytes make it unlikely for text or even binary keys to start with it.
+const tombstonePrefix = "\x00z.Buffer/tombstone\x00"
+
+// bufferBytes is the number of bytes held by UseCalloc buffers.
+var bufferBytes int64
+
+// bufferTagBytes is the number of bytes held by UseCalloc buffers, by tag.
+var bufferTagBytes = struct {
+	sync.Mutex
+	m map[string]int64
+}{m: make(map[string]int64)}
+
+// TotalBufferBytes returns the number of bytes allocated via Calloc which are held by UseCalloc
+// buffers across the process. Unlike NumAllocBytes, this is tracked with or without jemalloc.
+func TotalBufferBytes() int64 {
+	return atomic.LoadInt64(&bufferBytes)
+}
+
+// BufferBytesByLabel works like TotalBufferBytes, but breaks the bytes down by the label of the
+// buffers holding them, i.e. the tag passed to NewBuffer. As memory allocated via jemalloc doesn't
+// show up in Go's heap profiles, this helps to tell which buffers use up the memory.
+func BufferBytesByLabel() map[string]int64 {
+	bufferTagBytes.Lock()
+	defer bufferTagBytes.Unlock()
+	res := make(map[string]int64, len(bufferTagBytes.m))
+	for tag, n := range bufferTagBytes.m {
+		res[tag] = n
+	}
+	return res
+}
+
+func accountBuffer(tag string, delta int64) {
+	atomic.AddInt64(&bufferBytes, delta)
+	bufferTagBytes.Lock()
+	if n := bufferTagBytes.m[tag] + delta; n != 0 {
+		bufferTagBytes.m[tag] = n
+	} else {
+		delete(bufferTagBytes.m, tag)
+	}
+	bufferTagBytes.Unlock()
+}
+
+func callocBuffer(sz int, tag string) []byte {
+	accountBuffer(tag, int64(sz))
+	return Calloc(sz, tag)
+}
+
+func freeBuffer(buf []byte, tag string) {
+	accountBuffer(tag, -int64(len(buf)))
+	Free(buf)
+}
+
+// AllocGate, if set, is consulted by every Buffer before it reallocates, with the size of the new
+// allocation. Returning an error rejects the allocation, making Grow panic and the non-panicking
+// variants like SliceAllocateE return the error. This allows a process-wide memory governor to
+// control the memory used by all the buffers. It must be set before any buffers are used.
+var AllocGate func(requestedBytes int) error
+
+var (
+	memGuardFraction  float64                // fraction of the available memory a Grow may use
+	memGuardAvailable func() (uint64, error) // returns the available memory for the memory guard
+)
+
+// SetMemoryGuard makes the reallocations of UseCalloc buffers fail if they would allocate more
+// than fraction of the available memory, as returned by available. This turns runaway allocations,
+// e.g. due to bad input sizes, into errors instead of getting the process killed. If available is
+// nil, the memory available to the system is read from /proc/meminfo, and the check is skipped on
+// systems without it. A fraction of zero, the default, disables the guard. It must be set before
+// any buffers are used.
+func SetMemoryGuard(fraction float64, available func() (uint64, error)) {
+	if available == nil {
+		available = systemAvailableMemory
+	}
+	memGuardFraction, memGuardAvailable = fraction, available
+}
+
+// systemAvailableMemory returns the MemAvailable value from /proc/meminfo.
+func systemAvailableMemory() (uint64, error) {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var kb uint64
+		if _, err := fmt.Sscanf(string(line), "MemAvailable: %d kB", &kb); err == nil {
+			return kb << 10, nil
+		}
+	}
+	return 0, errors.New("MemAvailable not found in /proc/meminfo")
+}
+
+// checkMemoryGuard returns an error if allocating sz bytes would violate SetMemoryGuard.
+func checkMemoryGuard(sz int) error {
+	if memGuardFraction <= 0 {
+		return nil
+	}
+	avail, err := memGuardAvailable()
+	if err != nil {
+		// We can't tell, so let the allocation go through.
+		return nil
+	}
+	if limit := memGuardFraction * float64(avail); float64(sz) > limit {
+		return errors.Errorf("z.Buffer allocation of %d bytes exceeds %.0f bytes, %.2f of the "+
+			"available memory", sz, limit, memGuardFraction)
+	}
+	return nil
+}
+
+var (
+	growWarnThreshold int64 // Grow logs a warning for requests larger than this. 0 disables it.
+	growWarnLast      int64 // unix nanos of the last warning logged by Grow.
 )
 
-// Buffer is equivalent of bytes.Buffer without the ability to read. It is NOT thread-safe.
+// growWarnInterval is the minimum duration between two warnings logged by Grow.
+const growWarnInterval = time.Minute
+
+// SetGrowWarnThreshold makes Buffer.Grow log a warning, along with the stack trace, whenever a
+// single reallocation is asked for more than threshold bytes. Such large requests are often caused
+// by a bad length field rather than intent. The warnings are rate-limited to one per minute across
+// the process. A threshold of zero, the default, disables the warning.
+func SetGrowWarnThreshold(threshold int) {
+	atomic.StoreInt64(&growWarnThreshold, int64(threshold))
+}
+
+func warnLargeGrow(n, curSz int) {
+	threshold := atomic.LoadInt64(&growWarnThreshold)
+	if threshold <= 0 || int64(n) <= threshold {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&growWarnLast)
+	if now-last < int64(growWarnInterval) || !atomic.CompareAndSwapInt64(&growWarnLast, last, now) {
+		return
+	}
+	glog.Warningf("z.Buffer asked to grow by %d bytes (threshold: %d, capacity: %d) at:\n%s",
+		n, threshold, curSz, debug.Stack())
+}
+
+// Buffer is equivalent of bytes.Buffer. It is NOT thread-safe. Reads via Read don't consume the
+// written data, but move a separate read cursor, which can be moved back via SeekRead.
 //
 // In UseCalloc mode, z.Calloc is used to allocate memory, which depending upon how the code is
 // compiled could use jemalloc for allocations.
@@ -45,15 +222,141 @@ const (
 type Buffer struct {
 	padding       uint64     // number of starting bytes used for padding
 	offset        uint64     // used length of the buffer
+	readOff       int        // read cursor for Read, relative to StartOffset
+	readers       int32      // number of readers from NewReader which weren't closed yet
 	buf           []byte     // backing slice for the buffer
 	bufType       BufferType // type of the underlying buffer
 	curSz         int        // capacity of the buffer
+	initSz        int        // capacity the buffer was created with
 	maxSz         int        // causes a panic if the buffer grows beyond this size
+	maxSliceSz    int        // causes SliceAllocate to fail for slices larger than this size
+	softMaxSz     int        // size after which WouldExceedSoftLimit reports true
 	mmapFile      *MmapFile  // optional mmap backing for the buffer
 	autoMmapAfter int        // Calloc falls back to an mmaped tmpfile after crossing this size
 	autoMmapDir   string     // directory for autoMmap to create a tempfile in
+	spillAfter    int64      // Calloc falls back to mmap once all Calloc buffers cross this size
+	spilled       bool       // whether the buffer spilled over to mmap due to spillAfter
 	persistent    bool       // when enabled, Release will not delete the underlying mmap file
+	readOnly      bool       // when enabled, the mmap file is mapped PROT_READ and can't be written
+	syncWriteAt   bool       // when enabled, WriteAt msyncs the written range for UseMmap
+	poisonOnGrow  bool       // when enabled, Grow overwrites the old memory before freeing it
+	timestamps    bool       // when enabled, SliceAllocate prefixes slices with the time
+	varintLen     bool       // when enabled, slice lengths are encoded as uvarints
+	wideLen       bool       // when enabled, slice lengths are encoded as 8 bytes
+	fixedWidth    int        // when positive, slices are records of this size without lengths
 	tag           string     // used for jemalloc stats
+
+	growStrategy GrowStrategy // decides the new capacity on Grow, if set
+	minGrowth    int          // least Grow grows by, 0 meaning a page and -1 meaning no floor
+
+	largeSz    int                    // capacity at which onLargeSz fires
+	onLargeSz  func(b *Buffer, n int) // called once, the first time a Grow crosses largeSz
+	largeFired bool                   // whether onLargeSz was already called
+
+	// Growth bookkeeping, used to adapt the growth factor to bursts of reallocations.
+	growFactor int       // multiplier applied to curSz by Grow, 0 meaning 1
+	growBurst  int       // number of consecutive reallocations in quick succession
+	lastGrow   time.Time // time of the last reallocation
+	reallocs   int       // number of reallocations done by Grow
+	copied     int64     // number of bytes copied over by the reallocations
+
+	// Thrashing detection, i.e. buffers which keep getting grown and shrunk back.
+	grown       bool // whether Grow reallocated since the last cycle was counted
+	cycles      int  // number of times Renew or Shrink shrank the buffer after it grew
+	peakSz      int  // largest capacity the buffer grew to before a Renew or Shrink
+	thrashAfter int  // number of cycles after which a warning is logged, 0 meaning never
+	thrashWarn  bool // whether the warning was already logged
+}
+
+// GrowStrategy decides how much a Buffer grows by when it needs to be reallocated.
+type GrowStrategy interface {
+	// NextSize returns the new capacity for a buffer of capacity curSz, which has offset bytes
+	// written to it, and needs to fit requested more bytes. If the returned capacity is too small
+	// to fit them, the buffer grows to exactly fit them instead.
+	NextSize(curSz, offset, requested int) int
+}
+
+var (
+	// Doubling grows the buffer by its current capacity plus the requested bytes, up to 1GB at a
+	// time. Unlike the default strategy, it doesn't adapt to bursts of reallocations.
+	Doubling GrowStrategy = doubling{}
+	// Exact grows the buffer just enough to fit the requested bytes.
+	Exact GrowStrategy = exact{}
+)
+
+type doubling struct{}
+
+func (doubling) NextSize(curSz, offset, requested int) int {
+	return curSz + growBy(curSz, requested)
+}
+
+type exact struct{}
+
+func (exact) NextSize(curSz, offset, requested int) int {
+	return offset + requested
+}
+
+type linear int
+
+func (step linear) NextSize(curSz, offset, requested int) int {
+	// Add as many steps as needed to fit the requested bytes.
+	need := offset + requested - curSz
+	steps := (need + int(step) - 1) / int(step)
+	return curSz + steps*int(step)
+}
+
+// Linear grows the buffer by multiples of step bytes.
+func Linear(step int) GrowStrategy {
+	if step <= 0 {
+		panic(bufferPanic{errors.Errorf("invalid linear growth step: %d", step)})
+	}
+	return linear(step)
+}
+
+// GrowthFunc adapts a function to a GrowStrategy, for use with WithGrowStrategy. It's passed the
+// current capacity of the buffer, and the capacity it needs at least, i.e. the offset plus the
+// requested bytes. E.g. growing by 1.5x would be:
+//
+//	GrowthFunc(func(cur, need int) int { return cur + cur/2 })
+//
+// Like for any GrowStrategy, a returned capacity less than need is corrected to need.
+type GrowthFunc func(cur, need int) int
+
+// NextSize calls f(curSz, offset+requested).
+func (f GrowthFunc) NextSize(curSz, offset, requested int) int {
+	return f(curSz, offset+requested)
+}
+
+// BufferStats holds statistics about a Buffer, as returned by Buffer.Stats.
+type BufferStats struct {
+	// Reallocs is the number of times Grow had to reallocate the buffer.
+	Reallocs int
+	// GrowFactor is the multiple of the current capacity that the next reallocation would add.
+	// It goes up during bursts of reallocations, and decays back to 1 once growth stabilizes.
+	GrowFactor int
+	// SpillThreshold is the threshold set via WithSpillAfter.
+	SpillThreshold int64
+	// Spilled is whether the buffer was moved over to mmap because of SpillThreshold.
+	Spilled bool
+	// BytesCopied is the total number of bytes Grow copied over to newly allocated memory. A value
+	// much larger than the size of the buffer indicates that its initial capacity is too small.
+	BytesCopied int64
+	// GrowShrinkCycles is the number of times Renew or Shrink shrank the buffer back after it had
+	// grown. Unlike the other stats, it is kept across calls to Renew.
+	GrowShrinkCycles int
+}
+
+// Stats returns statistics about the buffer.
+func (b *Buffer) Stats() BufferStats {
+	return BufferStats{
+		Reallocs:       b.reallocs,
+		GrowFactor:     b.getGrowFactor(),
+		SpillThreshold: b.spillAfter,
+		Spilled:        b.spilled,
+		BytesCopied:    b.copied,
+
+		GrowShrinkCycles: b.cycles,
+	}
 }
 
 func NewBuffer(capacity int, tag string) *Buffer {
@@ -64,9 +367,10 @@ func NewBuffer(capacity int, tag string) *Buffer {
 		tag = defaultTag
 	}
 	return &Buffer{
-		buf:     Calloc(capacity, tag),
+		buf:     callocBuffer(capacity, tag),
 		bufType: UseCalloc,
 		curSz:   capacity,
+		initSz:  capacity,
 		offset:  8,
 		padding: 8,
 		tag:     tag,
@@ -88,15 +392,60 @@ func NewBufferPersistent(path string, capacity int) (*Buffer, error) {
 	return buffer, nil
 }
 
+// NewBufferReadOnly memory-maps the buffer file at path, e.g. one written via NewBufferPersistent,
+// for reading only. The file is opened O_RDONLY and mapped PROT_READ, so the OS can share its pages
+// across processes, and the file can't be corrupted by accident. Writing to the buffer returns an
+// error, or panics for the methods which don't return one, in-place sorts included. Use
+// SortSliceInto to sort it into another buffer. The offset is set to the size of the file, so the
+// slices can be read right away. This needs the file to end at the last slice written, as it does
+// after ReleaseKeepFile.
+func NewBufferReadOnly(path string) (*Buffer, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "cannot stat file: %s", path)
+	}
+	if fi.Size() < 8 {
+		file.Close()
+		return nil, errors.Errorf("file: %s of size: %d is too small for a buffer", path, fi.Size())
+	}
+	mmapFile, err := OpenMmapFileUsing(file, 0, false)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Buffer{
+		buf:        mmapFile.Data,
+		bufType:    UseMmap,
+		curSz:      len(mmapFile.Data),
+		initSz:     len(mmapFile.Data),
+		mmapFile:   mmapFile,
+		offset:     uint64(len(mmapFile.Data)),
+		padding:    8,
+		persistent: true,
+		readOnly:   true,
+	}, nil
+}
+
 func NewBufferTmp(dir string, capacity int) (*Buffer, error) {
 	if dir == "" {
-		dir = tmpDir
+		dir = nextTmpDir()
 	}
 	file, err := ioutil.TempFile(dir, "buffer")
 	if err != nil {
 		return nil, err
 	}
-	return newBufferFile(file, capacity)
+	buffer, err := newBufferFile(file, capacity)
+	if err != nil {
+		// Nobody else knows about the file, so don't leave it behind.
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return buffer, nil
 }
 
 func newBufferFile(file *os.File, capacity int) (*Buffer, error) {
@@ -105,12 +454,14 @@ func newBufferFile(file *os.File, capacity int) (*Buffer, error) {
 	}
 	mmapFile, err := OpenMmapFileUsing(file, capacity, true)
 	if err != nil && err != NewFile {
+		file.Close()
 		return nil, err
 	}
 	buf := &Buffer{
 		buf:      mmapFile.Data,
 		bufType:  UseMmap,
 		curSz:    len(mmapFile.Data),
+		initSz:   capacity,
 		mmapFile: mmapFile,
 		offset:   8,
 		padding:  8,
@@ -118,6 +469,19 @@ func newBufferFile(file *os.File, capacity int) (*Buffer, error) {
 	return buf, nil
 }
 
+// NewBufferFromBytes wraps data, which holds slices as returned by Bytes, in a buffer without
+// copying it, so the slice functions like SortSlice can be used over it. The spare capacity of data
+// can be written to, but the buffer can't grow beyond it. Release doesn't free data, which must
+// outlive the buffer.
+func NewBufferFromBytes(data []byte) *Buffer {
+	return &Buffer{
+		buf:     data[:cap(data)],
+		bufType: UseInvalid,
+		curSz:   cap(data),
+		offset:  uint64(len(data)),
+	}
+}
+
 func NewBufferSlice(slice []byte) *Buffer {
 	return &Buffer{
 		offset:  uint64(len(slice)),
@@ -128,14 +492,23 @@ func NewBufferSlice(slice []byte) *Buffer {
 
 func (b *Buffer) WithAutoMmap(threshold int, path string) *Buffer {
 	if b.bufType != UseCalloc {
-		panic("can only autoMmap with UseCalloc")
+		panic(bufferPanic{errors.New("can only autoMmap with UseCalloc")})
 	}
 	b.autoMmapAfter = threshold
-	if path == "" {
-		b.autoMmapDir = tmpDir
-	} else {
-		b.autoMmapDir = path
+	// If path is empty, the directory is picked when the tempfile gets created.
+	b.autoMmapDir = path
+	return b
+}
+
+// WithSpillAfter makes an UseCalloc buffer move over to an mmaped tempfile, instead of growing,
+// once the UseCalloc buffers of the whole process (see TotalBufferBytes) would hold more than
+// threshold bytes. This allows buffers to degrade gracefully under memory pressure. The tempfile
+// is created in the directory set via WithAutoMmap, if any.
+func (b *Buffer) WithSpillAfter(threshold int64) *Buffer {
+	if b.bufType != UseCalloc {
+		panic(bufferPanic{errors.New("can only spill with UseCalloc")})
 	}
+	b.spillAfter = threshold
 	return b
 }
 
@@ -144,6 +517,270 @@ func (b *Buffer) WithMaxSize(size int) *Buffer {
 	return b
 }
 
+// WithVarintLen makes the lengths of the slices be encoded as uvarints, instead of 4 bytes. This
+// saves up to 3 bytes per small slice, and allows slices larger than 4GB. Slice, SliceIterate,
+// SortSlice and the other slice functions all decode the lengths accordingly. It must be set before
+// any slices are written, and the buffer can't be read back by a buffer without it.
+func (b *Buffer) WithVarintLen() *Buffer {
+	if !b.IsEmpty() {
+		panic(bufferPanic{errors.New("WithVarintLen must be set on an empty buffer")})
+	}
+	if b.wideLen || b.fixedWidth > 0 {
+		panic(bufferPanic{errors.New("WithVarintLen can't be combined with other framing")})
+	}
+	b.varintLen = true
+	return b
+}
+
+// WithWideLen makes the lengths of the slices be encoded as 8 big-endian bytes, instead of 4, so
+// single slices can be larger than 4GB. Unlike WithVarintLen, the prefix has a fixed width, so
+// SliceAllocateCap and RecordEncoder keep working. Like WithVarintLen, it must be set before any
+// slices are written, and the buffer can only be read back by a buffer with it.
+func (b *Buffer) WithWideLen() *Buffer {
+	if !b.IsEmpty() {
+		panic(bufferPanic{errors.New("WithWideLen must be set on an empty buffer")})
+	}
+	if b.varintLen || b.fixedWidth > 0 {
+		panic(bufferPanic{errors.New("WithWideLen can't be combined with other framing")})
+	}
+	b.wideLen = true
+	return b
+}
+
+// WithFixedWidth makes the buffer hold records of exactly width bytes, without any length prefix,
+// saving 4 bytes per record. SliceAllocate and WriteSlice only accept slices of width bytes, and
+// RecordAt indexes the records directly. Slice, SliceIterate, SortSlice and the other slice
+// functions work as usual, with SortSlice finding its blocks of records without walking them. It
+// must be set before any slices are written, and can't be combined with WithVarintLen, WithWideLen
+// or WithTimestamps.
+func (b *Buffer) WithFixedWidth(width int) *Buffer {
+	if width <= 0 {
+		panic(bufferPanic{errors.Errorf("invalid record width: %d", width)})
+	}
+	if !b.IsEmpty() {
+		panic(bufferPanic{errors.New("WithFixedWidth must be set on an empty buffer")})
+	}
+	if b.varintLen || b.wideLen || b.timestamps {
+		panic(bufferPanic{errors.New("WithFixedWidth can't be combined with other framing")})
+	}
+	b.fixedWidth = width
+	return b
+}
+
+// RecordAt returns the i-th record of a buffer created with WithFixedWidth. It panics if there's
+// no such record.
+func (b *Buffer) RecordAt(i int) []byte {
+	if b.fixedWidth <= 0 {
+		panic(bufferPanic{errors.New("RecordAt needs WithFixedWidth")})
+	}
+	off := b.StartOffset() + i*b.fixedWidth
+	if i < 0 || off+b.fixedWidth > int(b.offset) {
+		panic(bufferPanic{errors.Errorf("record: %d out of range [0, %d)", i, b.NumSlices())})
+	}
+	return b.buf[off : off+b.fixedWidth]
+}
+
+// SetMaxSize changes the max size of the buffer, e.g. to allow for a payload which turned out to
+// be legitimately larger. A size of zero removes the max size. It returns an error, leaving the max
+// size as is, if the buffer was already written beyond size. For an UseMmap buffer using
+// ReserveMapping, the mapping stays as reserved: Grow remaps the file beyond it, invalidating the
+// slices obtained earlier, unless ReserveMapping is called again to extend the mapping.
+func (b *Buffer) SetMaxSize(size int) error {
+	if size < 0 {
+		return errors.Errorf("invalid max size: %d", size)
+	}
+	if size > 0 && size < int(b.offset) {
+		return errors.Errorf("max size: %d is below the bytes already written: %d",
+			size, b.offset)
+	}
+	b.maxSz = size
+	return nil
+}
+
+// WithMaxSliceSize limits the size of each individual slice allocated via SliceAllocate, regardless
+// of the overall limit set via WithMaxSize. This guards against a single record claiming a huge
+// size. SliceAllocate panics if the limit is exceeded, while SliceAllocateE returns an error.
+func (b *Buffer) WithMaxSliceSize(size int) *Buffer {
+	b.maxSliceSz = size
+	return b
+}
+
+// FileSize returns the number of bytes actually used on disk by the file backing an UseMmap
+// buffer. This can differ from the capacity of the buffer, because the file is allocated sparsely
+// as it gets written to. It returns an error for buffers without a backing file.
+func (b *Buffer) FileSize() (int64, error) {
+	if b.bufType != UseMmap || b.mmapFile == nil {
+		return 0, errors.Errorf("no backing file for a %s buffer", b.bufType)
+	}
+	fi, err := b.mmapFile.Fd.Stat()
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot stat file: %s", b.mmapFile.Fd.Name())
+	}
+	return diskUsage(fi), nil
+}
+
+// ResidentBytes returns the number of bytes of an UseMmap buffer which are actually resident in
+// memory, using mincore. Unlike the capacity of the buffer, this only accounts for the pages which
+// have been faulted in. It returns an error for buffers which aren't mmapped, and for platforms
+// without mincore.
+func (b *Buffer) ResidentBytes() (int64, error) {
+	if b.bufType != UseMmap || b.mmapFile == nil {
+		return 0, errors.Errorf("no mmapped region for a %s buffer", b.bufType)
+	}
+	return residentBytes(b.mmapFile.Data)
+}
+
+// WithGrowStrategy makes the buffer use the given strategy to decide its new capacity whenever it
+// needs to be reallocated. By default, the buffer doubles its capacity, growing faster during
+// bursts of reallocations, as documented on Grow.
+func (b *Buffer) WithGrowStrategy(strategy GrowStrategy) *Buffer {
+	b.growStrategy = strategy
+	return b
+}
+
+// WithMinGrowth sets the least number of bytes Grow grows the buffer by, so small buffers don't
+// go through many tiny reallocations while they fill up. It defaults to one page. A size of zero
+// or less disables the floor. It doesn't apply when using WithGrowStrategy.
+func (b *Buffer) WithMinGrowth(size int) *Buffer {
+	if size <= 0 {
+		size = -1
+	}
+	b.minGrowth = size
+	return b
+}
+
+// WithPoisonOnGrow makes Grow overwrite the old memory of an UseCalloc buffer with a garbage
+// pattern before freeing it. This is meant for debugging, to make the use of stale slices obtained
+// from the buffer before a Grow visible.
+func (b *Buffer) WithPoisonOnGrow(enabled bool) *Buffer {
+	b.poisonOnGrow = enabled
+	return b
+}
+
+// WithLargeSizeHook makes Grow call hook the first time the buffer's capacity reaches threshold,
+// with the number of bytes requested by that Grow. It fires only once per buffer, so it gives a
+// low-noise signal for catching buffers which grew unexpectedly large, e.g. by logging the stack.
+func (b *Buffer) WithLargeSizeHook(threshold int, hook func(b *Buffer, n int)) *Buffer {
+	b.largeSz, b.onLargeSz = threshold, hook
+	return b
+}
+
+// WithTimestamps makes SliceAllocate prefix every slice with the time it was allocated at, as 8
+// bytes of big-endian Unix nanoseconds. The slice returned by SliceAllocate excludes the timestamp,
+// while the slices returned by Slice and SliceIterate include it. Use SliceWithTime or
+// SplitTimestamp to separate the timestamp from the payload, e.g. to expire slices via Compact.
+// This should not be combined with SliceAllocateWithCRC, whose trailer only covers the payload.
+func (b *Buffer) WithTimestamps() *Buffer {
+	if b.fixedWidth > 0 {
+		panic(bufferPanic{errors.New("WithTimestamps can't be combined with WithFixedWidth")})
+	}
+	b.timestamps = true
+	return b
+}
+
+// WithSoftMaxSize sets a soft limit on the size of the buffer, which is only reported by
+// WouldExceedSoftLimit and never enforced. It should be lower than the max size, so producers of
+// slices can roll over to a new buffer at a record boundary, before hitting the hard limit.
+func (b *Buffer) WithSoftMaxSize(size int) *Buffer {
+	b.softMaxSz = size
+	return b
+}
+
+// WouldExceedSoftLimit returns whether allocating a slice of size n via SliceAllocate would take
+// the buffer beyond the soft limit set via WithSoftMaxSize.
+func (b *Buffer) WouldExceedSoftLimit(n int) bool {
+	if b.softMaxSz <= 0 {
+		return false
+	}
+	sz := b.lenSize(n) + n
+	if b.timestamps {
+		sz = b.lenSize(timestampSize+n) + timestampSize + n
+	}
+	return int(b.offset)+sz > b.softMaxSz
+}
+
+// WithSyncWriteAt makes every WriteAt on an UseMmap buffer msync the pages it wrote to. This gives
+// a consistency point to other processes reading the same file. It has no effect on other buffers.
+func (b *Buffer) WithSyncWriteAt(enabled bool) *Buffer {
+	b.syncWriteAt = enabled
+	return b
+}
+
+// ReserveMapping maps the file backing an UseMmap buffer up to its max size upfront, while the file
+// itself only grows as needed. This way, Grow doesn't need to remap the file as long as the buffer
+// stays within the max size, and the slices obtained from the buffer stay valid across a Grow. The
+// max size must be set via WithMaxSize before calling ReserveMapping. Note that on Windows, the
+// file gets expanded to the max size right away.
+func (b *Buffer) ReserveMapping() error {
+	if b.bufType != UseMmap {
+		return errors.Errorf("cannot reserve mapping for a %s buffer", b.bufType)
+	}
+	if b.maxSz <= b.curSz {
+		return nil
+	}
+	// Map the new region before unmapping the old one, so the buffer stays usable if either fails.
+	// Both map the same file, so nothing needs to be copied over.
+	data, err := Mmap(b.mmapFile.Fd, true, int64(b.maxSz))
+	if err != nil {
+		return errors.Wrapf(err, "while mmapping %s with size: %d", b.mmapFile.Fd.Name(), b.maxSz)
+	}
+	if err := Munmap(b.mmapFile.Data); err != nil {
+		_ = Munmap(data)
+		return errors.Wrapf(err, "while munmap file: %s", b.mmapFile.Fd.Name())
+	}
+	b.mmapFile.Data = data
+	b.buf = data[:b.curSz]
+	return nil
+}
+
+// Capacity returns the number of bytes which can be written to the buffer, padding included,
+// before it needs to grow.
+func (b *Buffer) Capacity() int {
+	return b.curSz
+}
+
+// MaxSize returns the max size set via WithMaxSize, or 0 if the buffer has no max size.
+func (b *Buffer) MaxSize() int {
+	return b.maxSz
+}
+
+// Type returns the type of memory backing the buffer. It changes if the buffer gets moved over to
+// mmap, e.g. via WithAutoMmap or ConvertTo.
+func (b *Buffer) Type() BufferType {
+	return b.bufType
+}
+
+// Advise passes the given advice about the expected access pattern of the buffer to the kernel via
+// madvise. It's a no-op for buffers not backed by mmap, and on platforms without madvise.
+func (b *Buffer) Advise(advice MadviseAdvice) error {
+	if b.bufType != UseMmap || len(b.buf) == 0 {
+		return nil
+	}
+	if err := advise(b.buf[:b.curSz], advice); err != nil {
+		return errors.Wrapf(err, "while advising %s", b.mmapFile.Fd.Name())
+	}
+	return nil
+}
+
+// checkWritable returns an error if the buffer was opened via NewBufferReadOnly.
+func (b *Buffer) checkWritable() error {
+	if !b.readOnly {
+		return nil
+	}
+	if b.mmapFile == nil || b.mmapFile.Fd == nil {
+		// The buffer was released, so there's no file name to report.
+		return errors.New("cannot write to read-only z.Buffer")
+	}
+	return errors.Errorf("cannot write to read-only z.Buffer: %s", b.mmapFile.Fd.Name())
+}
+
+// mustBeWritable panics if the buffer was opened via NewBufferReadOnly.
+func (b *Buffer) mustBeWritable() {
+	if err := b.checkWritable(); err != nil {
+		panic(bufferPanic{err})
+	}
+}
+
 func (b *Buffer) IsEmpty() bool {
 	return int(b.offset) == b.StartOffset()
 }
@@ -160,87 +797,365 @@ func (b *Buffer) LenNoPadding() int {
 	return int(atomic.LoadUint64(&b.offset) - b.padding)
 }
 
-// Bytes would return all the written bytes as a slice.
+// Bytes would return all the written bytes as a slice. The slice aliases the memory of the buffer,
+// so it is only valid until the next call which may Grow the buffer, like Write or Allocate. In
+// UseCalloc mode, such a call can reallocate the buffer, leaving the slice pointing to freed
+// memory. Use BytesCopy to hold on to the bytes across such calls.
 func (b *Buffer) Bytes() []byte {
 	off := atomic.LoadUint64(&b.offset)
 	return b.buf[b.padding:off]
 }
 
+// BytesCopy returns a copy of all the written bytes, which stays valid regardless of what happens
+// to the buffer afterwards.
+func (b *Buffer) BytesCopy() []byte {
+	return append([]byte{}, b.Bytes()...)
+}
+
 // Grow would grow the buffer to have at least n more bytes. In case the buffer is at capacity, it
 // would reallocate twice the size of current capacity + n, to ensure n bytes can be written to the
-// buffer without further allocation. In UseMmap mode, this might result in underlying file
-// expansion.
+// buffer without further allocation. If reallocations keep happening in quick succession, the
+// buffer grows by larger multiples of its capacity, up to 8x, until growth stabilizes. In UseMmap
+// mode, this might result in underlying file expansion, followed by a remap of the file unless
+// ReserveMapping was used.
 func (b *Buffer) Grow(n int) {
+	if err := b.grow(n); err != nil {
+		panic(bufferPanic{err})
+	}
+}
+
+// TryGrow works like Grow, but returns an error instead of panicking, e.g. a *MaxSizeError if the
+// buffer would grow beyond its max size. The buffer is left untouched if an error is returned.
+func (b *Buffer) TryGrow(n int) error {
+	return b.grow(n)
+}
+
+// Reserve makes room for n more bytes without changing the length of the buffer, like
+// bytes.Buffer.Grow, so that a burst of small writes doesn't reallocate repeatedly. It's the same
+// as Grow, under the name used by other containers.
+func (b *Buffer) Reserve(n int) {
+	b.Grow(n)
+}
+
+// MaxSizeError is returned when a buffer would outgrow the max size set via WithMaxSize.
+type MaxSizeError struct {
+	MaxSize int // max size of the buffer
+	Offset  int // offset the buffer was written up to
+	N       int // number of bytes the buffer was asked to grow by
+}
+
+func (e *MaxSizeError) Error() string {
+	return fmt.Sprintf("z.Buffer max size exceeded: %d offset: %d grow: %d",
+		e.MaxSize, e.Offset, e.N)
+}
+
+// grow implements Grow, but returns an error instead of panicking. The buffer is left untouched
+// if an error is returned.
+func (b *Buffer) grow(n int) error {
 	if b.buf == nil {
-		panic("z.Buffer needs to be initialized before using")
+		return errors.New("z.Buffer needs to be initialized before using")
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
 	}
 	if b.maxSz > 0 && int(b.offset)+n > b.maxSz {
-		err := fmt.Errorf(
-			"z.Buffer max size exceeded: %d offset: %d grow: %d", b.maxSz, b.offset, n)
-		panic(err)
+		return &MaxSizeError{MaxSize: b.maxSz, Offset: int(b.offset), N: n}
 	}
-	if int(b.offset)+n < b.curSz {
-		return
+	if int(b.offset)+n <= b.curSz {
+		return nil
 	}
+	warnLargeGrow(n, b.curSz)
 
 	// Calculate new capacity.
-	growBy := b.curSz + n
-	// Don't allocate more than 1GB at a time.
-	if growBy > 1<<30 {
-		growBy = 1 << 30
+	now := time.Now()
+	factor, burst := b.getGrowFactor(), 0
+	var newSz int
+	if b.growStrategy != nil {
+		newSz = b.growStrategy.NextSize(b.curSz, int(b.offset), n)
+	} else {
+		// Adapt the growth factor. Bursts of small reallocations make it go up, so fewer
+		// reallocations are needed. Otherwise, it decays back to 1. Buffers with a max size are
+		// meant to bound their memory, so they don't take part.
+		if b.maxSz == 0 && n < b.curSz && now.Sub(b.lastGrow) < growBurstWindow {
+			burst = b.growBurst + 1
+		}
+		switch {
+		case burst >= growBurstLen && factor < maxGrowFactor:
+			factor, burst = factor*2, 0
+		case burst == 0 && factor > 1:
+			factor /= 2
+		}
+		newSz = b.curSz + growBy(b.curSz*factor, n)
+		if floor := b.getMinGrowth(); newSz-b.curSz < floor {
+			newSz = b.curSz + floor
+		}
 	}
-	// Allocate at least n, even if it exceeds the 1GB limit above.
-	if n > growBy {
-		growBy = n
+	// Whatever the strategy says, the buffer must fit n more bytes, but not grow beyond its max
+	// size. The max size was checked to fit them above.
+	if need := int(b.offset) + n; newSz < need {
+		newSz = need
+	}
+	if b.maxSz > 0 && newSz > b.maxSz {
+		newSz = b.maxSz
+	}
+	if AllocGate != nil {
+		if err := AllocGate(newSz); err != nil {
+			return errors.Wrapf(err, "z.Buffer allocation of %d bytes rejected", newSz)
+		}
 	}
-	b.curSz += growBy
 
 	switch b.bufType {
 	case UseCalloc:
-		// If autoMmap gets triggered, copy the slice over to an mmaped file.
-		if b.autoMmapAfter > 0 && b.curSz > b.autoMmapAfter {
-			b.bufType = UseMmap
-			file, err := ioutil.TempFile(b.autoMmapDir, "")
+		// Spill over to mmap if the Calloc buffers of the process are using too much memory.
+		spill := b.spillAfter > 0 && TotalBufferBytes()+int64(newSz-b.curSz) > b.spillAfter
+		// If autoMmap or a spill gets triggered, copy the slice over to an mmaped file.
+		if spill || (b.autoMmapAfter > 0 && newSz > b.autoMmapAfter) {
+			mmapFile, err := newMmapBacking(b.autoMmapDir, newSz)
 			if err != nil {
-				panic(err)
-			}
-			mmapFile, err := OpenMmapFileUsing(file, b.curSz, true)
-			if err != nil && err != NewFile {
-				panic(err)
+				return err
 			}
 			assert(int(b.offset) == copy(mmapFile.Data, b.buf[:b.offset]))
-			Free(b.buf)
+			b.copied += int64(b.offset)
+			freeBuffer(b.buf, b.tag)
+			b.spilled = spill
+			b.bufType = UseMmap
 			b.mmapFile = mmapFile
 			b.buf = mmapFile.Data
 			break
 		}
 
 		// Else, reallocate the slice.
-		newBuf := Calloc(b.curSz, b.tag)
+		if err := checkMemoryGuard(newSz); err != nil {
+			return err
+		}
+		newBuf := callocBuffer(newSz, b.tag)
 		assert(int(b.offset) == copy(newBuf, b.buf[:b.offset]))
-		Free(b.buf)
+		b.copied += int64(b.offset)
+		if b.poisonOnGrow {
+			poison(b.buf)
+		}
+		freeBuffer(b.buf, b.tag)
 		b.buf = newBuf
 
 	case UseMmap:
+		// Grow by whole pages, so the last page doesn't get faulted in again by every Grow.
+		if rem := newSz % pageSize; rem != 0 && (b.maxSz == 0 || newSz+pageSize-rem <= b.maxSz) {
+			newSz += pageSize - rem
+		}
+		// If the mapping was reserved beyond the file, only the file needs to be expanded.
+		if reserved := len(b.mmapFile.Data); reserved > b.curSz && int(b.offset)+n <= reserved {
+			if newSz > reserved {
+				newSz = reserved
+			}
+			if err := b.mmapFile.Fd.Truncate(int64(newSz)); err != nil {
+				return errors.Wrapf(err,
+					"while trying to truncate file: %s to size: %d", b.mmapFile.Fd.Name(), newSz)
+			}
+			b.buf = b.mmapFile.Data[:newSz]
+			break
+		}
+
 		// Truncate and remap the underlying file.
-		if err := b.mmapFile.Truncate(int64(b.curSz)); err != nil {
-			err = errors.Wrapf(err,
-				"while trying to truncate file: %s to size: %d", b.mmapFile.Fd.Name(), b.curSz)
-			panic(err)
+		if err := b.mmapFile.Truncate(int64(newSz)); err != nil {
+			return errors.Wrapf(err,
+				"while trying to truncate file: %s to size: %d", b.mmapFile.Fd.Name(), newSz)
 		}
 		b.buf = b.mmapFile.Data
 
 	default:
-		panic("can only use Grow on UseCalloc and UseMmap buffers")
+		return errors.New("can only use Grow on UseCalloc and UseMmap buffers")
+	}
+	b.curSz = newSz
+	if b.growStrategy == nil {
+		b.growFactor, b.growBurst, b.lastGrow = factor, burst, now
 	}
+	b.reallocs++
+	b.grown = true
+	if b.onLargeSz != nil && !b.largeFired && b.curSz >= b.largeSz {
+		b.largeFired = true
+		b.onLargeSz(b, n)
+	}
+	return nil
 }
 
-// Allocate is a way to get a slice of size n back from the buffer. This slice can be directly
-// written to. Warning: Allocate is not thread-safe. The byte slice returned MUST be used before
-// further calls to Buffer.
-func (b *Buffer) Allocate(n int) []byte {
-	b.Grow(n)
-	off := b.offset
+// growBy returns how much to grow a buffer by, to fit n more bytes, given a base size. This is
+// base + n, capped at 1GB, but always at least n.
+func growBy(base, n int) int {
+	growBy := base + n
+	// Don't allocate more than 1GB at a time.
+	if growBy > 1<<30 {
+		growBy = 1 << 30
+	}
+	// Allocate at least n, even if it exceeds the 1GB limit above.
+	if n > growBy {
+		growBy = n
+	}
+	return growBy
+}
+
+func (b *Buffer) getMinGrowth() int {
+	switch b.minGrowth {
+	case 0:
+		return pageSize
+	case -1:
+		return 0
+	}
+	return b.minGrowth
+}
+
+func (b *Buffer) getGrowFactor() int {
+	if b.growFactor == 0 {
+		return 1
+	}
+	return b.growFactor
+}
+
+// WillGrow returns whether writing n more bytes to the buffer would make Grow reallocate the
+// buffer, or truncate the underlying file in UseMmap mode. Either can be slow, so latency sensitive
+// callers can use this to call Grow ahead of time, outside of their critical path.
+func (b *Buffer) WillGrow(n int) bool {
+	return int(b.offset)+n > b.curSz
+}
+
+// GrowReport works like Grow, but also reports the capacity of the buffer before and after the
+// call, and whether the buffer had to be reallocated to fit n more bytes.
+func (b *Buffer) GrowReport(n int) (oldCap, newCap int, reallocated bool) {
+	oldCap = b.curSz
+	b.Grow(n)
+	return oldCap, b.curSz, b.curSz != oldCap
+}
+
+// newMmapBacking creates a tempfile in dir and mmaps it with sz bytes.
+func newMmapBacking(dir string, sz int) (*MmapFile, error) {
+	if dir == "" {
+		dir = nextTmpDir()
+	}
+	file, err := ioutil.TempFile(dir, "buffer")
+	if err != nil {
+		return nil, err
+	}
+	mmapFile, err := OpenMmapFileUsing(file, sz, true)
+	if err != nil && err != NewFile {
+		// Nobody else knows about the file, so don't leave it behind.
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return mmapFile, nil
+}
+
+// Clone returns an independent copy of the buffer, with the same options and written bytes. A
+// UseMmap buffer is copied into a new tmpfile in the same directory, which is deleted on Release
+// even if the original is persistent. Other buffers are copied into memory allocated via Calloc.
+// Stats start afresh for the clone.
+func (b *Buffer) Clone() (*Buffer, error) {
+	sz := int(b.offset)
+	if sz < defaultCapacity {
+		sz = defaultCapacity
+	}
+	clone := *b
+	clone.readOff, clone.readers = 0, 0
+	clone.reallocs, clone.copied, clone.cycles, clone.peakSz = 0, 0, 0, 0
+	clone.largeFired, clone.thrashWarn, clone.spilled = false, false, false
+	clone.persistent, clone.readOnly = false, false
+	if b.bufType == UseMmap {
+		tmp, err := NewBufferTmp(filepath.Dir(b.mmapFile.Fd.Name()), sz)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while cloning buffer")
+		}
+		clone.buf, clone.mmapFile = tmp.buf, tmp.mmapFile
+	} else {
+		clone.bufType, clone.mmapFile = UseCalloc, nil
+		clone.buf = callocBuffer(sz, b.tag)
+	}
+	clone.curSz = len(clone.buf)
+	copy(clone.buf, b.buf[:b.offset])
+	return &clone, nil
+}
+
+// ConvertTo moves the contents of the buffer over to a new backing of the given type. It is a
+// shorthand for ConvertToCtx without cancellation or progress reporting.
+func (b *Buffer) ConvertTo(bufType BufferType) error {
+	return b.ConvertToCtx(context.Background(), bufType, nil)
+}
+
+// ConvertToCtx moves the contents of the buffer over to a new backing of the given type. The copy
+// is done in chunks of convertChunkSize bytes. After every chunk, progress (if not nil) is called
+// with the number of bytes copied so far and the total, and ctx is checked for cancellation. If
+// ctx gets cancelled, the partially filled target is released and the buffer is left untouched.
+func (b *Buffer) ConvertToCtx(ctx context.Context, bufType BufferType,
+	progress func(done, total int)) error {
+	if b.bufType == bufType {
+		return nil
+	}
+	if b.bufType != UseCalloc && b.bufType != UseMmap {
+		return errors.Errorf("cannot convert a %s buffer", b.bufType)
+	}
+
+	var newBuf []byte
+	var mmapFile *MmapFile
+	switch bufType {
+	case UseCalloc:
+		newBuf = callocBuffer(b.curSz, b.tag)
+	case UseMmap:
+		var err error
+		if mmapFile, err = newMmapBacking(b.autoMmapDir, b.curSz); err != nil {
+			return errors.Wrapf(err, "while creating mmap backing for conversion")
+		}
+		newBuf = mmapFile.Data
+	default:
+		return errors.Errorf("cannot convert to a %s buffer", bufType)
+	}
+
+	total := int(b.offset)
+	for done := 0; done < total; {
+		if err := ctx.Err(); err != nil {
+			if mmapFile != nil {
+				_ = mmapFile.Delete()
+			} else {
+				freeBuffer(newBuf, b.tag)
+			}
+			return err
+		}
+		end := done + convertChunkSize
+		if end > total {
+			end = total
+		}
+		assert(end-done == copy(newBuf[done:end], b.buf[done:end]))
+		done = end
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+
+	// Release the old backing. A persistent file is closed but kept on disk.
+	switch b.bufType {
+	case UseCalloc:
+		freeBuffer(b.buf, b.tag)
+	case UseMmap:
+		path := b.mmapFile.Fd.Name()
+		if err := b.mmapFile.Close(-1); err != nil {
+			return errors.Wrapf(err, "while closing file: %s", path)
+		}
+		if !b.persistent {
+			if err := os.Remove(path); err != nil {
+				return errors.Wrapf(err, "while deleting file %s", path)
+			}
+		}
+	}
+	b.buf = newBuf
+	b.bufType = bufType
+	b.mmapFile = mmapFile
+	b.persistent, b.readOnly = false, false
+	return nil
+}
+
+// Allocate is a way to get a slice of size n back from the buffer. This slice can be directly
+// written to. Warning: Allocate is not thread-safe. The byte slice returned MUST be used before
+// further calls to Buffer.
+func (b *Buffer) Allocate(n int) []byte {
+	b.Grow(n)
+	off := b.offset
 	b.offset += uint64(n)
 	return b.buf[off:int(b.offset)]
 }
@@ -254,8 +1169,7 @@ func (b *Buffer) AllocateOffset(n int) int {
 }
 
 func (b *Buffer) writeLen(sz int) {
-	buf := b.Allocate(4)
-	binary.BigEndian.PutUint32(buf, uint32(sz))
+	b.putLen(b.Allocate(b.lenSize(sz)), sz)
 }
 
 // SliceAllocate would encode the size provided into the buffer, followed by a call to Allocate,
@@ -263,9 +1177,353 @@ func (b *Buffer) writeLen(sz int) {
 // this big buffer.
 // Note that SliceAllocate should NOT be mixed with normal calls to Write.
 func (b *Buffer) SliceAllocate(sz int) []byte {
-	b.Grow(4 + sz)
+	slice, err := b.SliceAllocateE(sz)
+	if err != nil {
+		panic(bufferPanic{err})
+	}
+	return slice
+}
+
+// SliceAllocateE works like SliceAllocate, but returns an error instead of panicking if the slice
+// can't be allocated, e.g. because it exceeds the max slice size or the max size of the buffer, or
+// its length doesn't fit in the 4-byte length prefix.
+func (b *Buffer) SliceAllocateE(sz int) ([]byte, error) {
+	if b.maxSliceSz > 0 && sz > b.maxSliceSz {
+		return nil, errors.Errorf("z.Buffer max slice size exceeded: %d slice: %d",
+			b.maxSliceSz, sz)
+	}
+	if sz < 0 {
+		return nil, errors.Errorf("z.Buffer invalid slice size: %d", sz)
+	}
+	if b.fixedWidth > 0 && sz != b.fixedWidth {
+		return nil, errors.Errorf("z.Buffer slice size: %d doesn't match record width: %d",
+			sz, b.fixedWidth)
+	}
+	ln := uint64(sz)
+	if b.timestamps {
+		ln += timestampSize
+	}
+	if !b.varintLen && !b.wideLen && ln > math.MaxUint32 {
+		return nil, errors.Errorf("z.Buffer slice size: %d overflows its 4-byte length, "+
+			"consider using WithWideLen", sz)
+	}
+	if b.timestamps {
+		if err := b.grow(b.lenSize(timestampSize+sz) + timestampSize + sz); err != nil {
+			return nil, err
+		}
+		b.writeLen(timestampSize + sz)
+		binary.BigEndian.PutUint64(b.Allocate(timestampSize), uint64(time.Now().UnixNano()))
+		return b.Allocate(sz), nil
+	}
+	if err := b.grow(b.lenSize(sz) + sz); err != nil {
+		return nil, err
+	}
+	b.writeLen(sz)
+	return b.Allocate(sz), nil
+}
+
+// SliceAllocateCap allocates a slice of capSz bytes, for a record whose final size is only known
+// after filling it in. setLen sets the length of the slice to actual, giving back the unused
+// trailing bytes, and returns the offset of the slice, to be used with Slice. As the space can
+// only be given back at the end of the buffer, setLen must be called before allocating anything
+// else from the buffer, else it panics. It isn't supported with WithVarintLen.
+func (b *Buffer) SliceAllocateCap(capSz int) (slice []byte, setLen func(actual int) int) {
+	if b.varintLen {
+		panic(bufferPanic{errors.New("SliceAllocateCap is not supported with varint lengths")})
+	}
+	start := int(b.offset)
+	slice = b.SliceAllocate(capSz)
+	end := int(b.offset)
+	// Account for anything written between the length and the slice, e.g. a timestamp.
+	prefix := end - capSz - start - b.lenSize(0)
+	setLen = func(actual int) int {
+		if actual < 0 || actual > capSz {
+			panic(bufferPanic{errors.Errorf("invalid length: %d for slice of cap: %d",
+				actual, capSz)})
+		}
+		if int(b.offset) != end {
+			panic(bufferPanic{errors.New("buffer was written to before setting the slice length")})
+		}
+		b.putLen(b.buf[start:], prefix+actual)
+		b.offset = uint64(end - capSz + actual)
+		return start
+	}
+	return slice, setLen
+}
+
+// SplitTimestamp splits a slice of a buffer using WithTimestamps into the time it was written at,
+// in Unix nanoseconds, and its payload.
+func SplitTimestamp(slice []byte) (ts int64, payload []byte) {
+	return int64(binary.BigEndian.Uint64(slice)), slice[timestampSize:]
+}
+
+// SliceWithTime works like Slice for buffers using WithTimestamps, but returns the time the slice
+// was written at, in Unix nanoseconds, separately from its payload.
+func (b *Buffer) SliceWithTime(offset int) (ts int64, payload []byte, next int) {
+	slice, next := b.Slice(offset)
+	if slice == nil {
+		return 0, nil, next
+	}
+	ts, payload = SplitTimestamp(slice)
+	return ts, payload, next
+}
+
+// SliceAllocateWithCRC works like SliceAllocate, but reserves a 4-byte CRC32 (Castagnoli) trailer
+// after the returned slice, within the same length-prefixed record. Once the slice has been filled
+// in, seal MUST be called to compute the trailer over it. The record can then be read back via
+// ReadSliceVerified or SliceIterateVerified, which check and strip the trailer.
+func (b *Buffer) SliceAllocateWithCRC(sz int) (slice []byte, seal func()) {
+	b.SliceAllocate(sz + crcSize)
+	start := int(b.offset) - crcSize - sz
+	seal = func() {
+		crc := crc32.Checksum(b.buf[start:start+sz], crcTable)
+		binary.BigEndian.PutUint32(b.buf[start+sz:], crc)
+	}
+	return b.buf[start : start+sz], seal
+}
+
+// ReadSliceVerified returns the slice written via SliceAllocateWithCRC at offset, along with the
+// offset of the next slice, just like Slice. It returns an error if the CRC trailer doesn't match
+// the slice.
+func (b *Buffer) ReadSliceVerified(offset int) ([]byte, int, error) {
+	slice, next := b.Slice(offset)
+	if len(slice) < crcSize {
+		return nil, next, errors.Errorf("slice at offset %d is too short to have a CRC", offset)
+	}
+	slice, trailer := slice[:len(slice)-crcSize], slice[len(slice)-crcSize:]
+	if crc32.Checksum(slice, crcTable) != binary.BigEndian.Uint32(trailer) {
+		return nil, next, errors.Errorf("CRC mismatch for slice at offset %d", offset)
+	}
+	return slice, next, nil
+}
+
+// SliceIterateVerified works like SliceIterate over slices written via SliceAllocateWithCRC. Each
+// slice is verified against its CRC trailer, which is stripped before calling f.
+func (b *Buffer) SliceIterateVerified(f func(slice []byte) error) error {
+	if b.IsEmpty() {
+		return nil
+	}
+	for next := b.StartOffset(); next >= 0; {
+		var slice []byte
+		var err error
+		if slice, next, err = b.ReadSliceVerified(next); err != nil {
+			return err
+		}
+		if err := f(slice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordEncoder writes a length-prefixed slice field by field, for records whose final size isn't
+// known upfront. The length prefix is filled in by Finish. No other writes must be made to the
+// buffer until Finish is called.
+type RecordEncoder struct {
+	b     *Buffer
+	start int
+}
+
+// RecordEncoder starts a new slice in the buffer, reserving space for estimatedSize bytes. The
+// record can grow beyond estimatedSize as the fields get written. With WithTimestamps, the record
+// is prefixed with the time it was started at, like for SliceAllocate. It isn't supported with
+// WithVarintLen.
+func (b *Buffer) RecordEncoder(estimatedSize int) *RecordEncoder {
+	if b.varintLen {
+		panic(bufferPanic{errors.New("RecordEncoder is not supported with varint lengths")})
+	}
+	b.Grow(b.lenSize(0) + timestampSize + estimatedSize)
+	enc := &RecordEncoder{b: b, start: int(b.offset)}
+	b.writeLen(0)
+	if b.timestamps {
+		binary.BigEndian.PutUint64(b.Allocate(timestampSize), uint64(time.Now().UnixNano()))
+	}
+	return enc
+}
+
+// Bytes appends the field as is to the record.
+func (e *RecordEncoder) Bytes(field []byte) {
+	check2(e.b.Write(field))
+}
+
+// Uint32 appends v to the record in big-endian order.
+func (e *RecordEncoder) Uint32(v uint32) {
+	binary.BigEndian.PutUint32(e.b.Allocate(4), v)
+}
+
+// Uint64 appends v to the record in big-endian order.
+func (e *RecordEncoder) Uint64(v uint64) {
+	binary.BigEndian.PutUint64(e.b.Allocate(8), v)
+}
+
+// Finish fills in the length prefix of the record and returns its offset, which can be passed to
+// Slice.
+func (e *RecordEncoder) Finish() int {
+	sz := int(e.b.offset) - e.start - e.b.lenSize(0)
+	if !e.b.wideLen && uint64(sz) > math.MaxUint32 {
+		panic(bufferPanic{errors.Errorf("z.Buffer record size: %d overflows its length", sz)})
+	}
+	e.b.putLen(e.b.buf[e.start:], sz)
+	return e.start
+}
+
+// SliceAllocateFromReader allocates a slice of size n via SliceAllocate, and fills it by reading
+// exactly n bytes from r directly into the buffer. If r runs out before n bytes are read, the
+// allocation is rolled back and io.ErrUnexpectedEOF is returned.
+func (b *Buffer) SliceAllocateFromReader(r io.Reader, n int) ([]byte, error) {
+	start := b.offset
+	slice, err := b.SliceAllocateE(n)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, slice); err != nil {
+		b.offset = start
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return slice, nil
+}
+
+// ReadFramedFrom reads length-prefixed slices from r, as returned by Bytes or written by
+// WriteToBySlices, and appends them to the buffer via SliceAllocate, until r returns io.EOF. It
+// returns the number of slices read. The prefixes and slices may be split across reads in any
+// way. If r ends in the middle of a slice, the partial slice is dropped and io.ErrUnexpectedEOF is
+// returned. With WithTimestamps, the slices keep the timestamps they were read with.
+func (b *Buffer) ReadFramedFrom(r io.Reader) (int, error) {
+	var hdr [8]byte
+	for count := 0; ; count++ {
+		if b.fixedWidth > 0 {
+			// Without prefixes, only a record cut short tells a truncated r apart from its end.
+			start := b.offset
+			slice, err := b.SliceAllocateE(b.fixedWidth)
+			if err != nil {
+				return count, err
+			}
+			if _, err := io.ReadFull(r, slice); err != nil {
+				b.offset = start
+				if err == io.EOF {
+					return count, nil
+				}
+				return count, err
+			}
+			continue
+		}
+		var sz int
+		if b.varintLen {
+			v, err := binary.ReadUvarint(byteReader{r})
+			if err == io.EOF {
+				return count, nil
+			} else if err != nil {
+				return count, err
+			}
+			sz = int(v)
+		} else {
+			if _, err := io.ReadFull(r, hdr[:b.lenSize(0)]); err == io.EOF {
+				return count, nil
+			} else if err != nil {
+				return count, err
+			}
+			sz, _ = b.readLen(hdr[:])
+		}
+		if b.timestamps {
+			// The frame already holds the timestamp it was written with, so it's copied as is,
+			// instead of getting stamped again by SliceAllocate.
+			if err := b.readFrameFrom(r, sz); err != nil {
+				return count, err
+			}
+			continue
+		}
+		if _, err := b.SliceAllocateFromReader(r, sz); err != nil {
+			return count, err
+		}
+	}
+}
+
+// readFrameFrom appends a frame holding sz bytes read from r, i.e. a timestamp and its payload,
+// without adding a timestamp of its own.
+func (b *Buffer) readFrameFrom(r io.Reader, sz int) error {
+	if sz < timestampSize {
+		return errors.Errorf("z.Buffer frame of size: %d is too small to hold a timestamp", sz)
+	}
+	start := b.offset
+	if err := b.grow(b.lenSize(sz) + sz); err != nil {
+		return err
+	}
 	b.writeLen(sz)
-	return b.Allocate(sz)
+	if _, err := io.ReadFull(r, b.Allocate(sz)); err != nil {
+		b.offset = start
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// byteReader reads a byte at a time from an io.Reader, e.g. for binary.ReadUvarint.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+// WriteTombstone writes a slice marking key as deleted. Tombstones can be told apart from other
+// slices using IsTombstone, and are dropped along with the slices they delete by DropTombstones.
+func (b *Buffer) WriteTombstone(key []byte) {
+	dst := b.SliceAllocate(len(tombstonePrefix) + len(key))
+	copy(dst[copy(dst, tombstonePrefix):], key)
+}
+
+// IsTombstone returns whether the slice was written via WriteTombstone.
+func IsTombstone(slice []byte) bool {
+	return bytes.HasPrefix(slice, []byte(tombstonePrefix))
+}
+
+// TombstoneKey returns the key deleted by a slice written via WriteTombstone.
+func TombstoneKey(slice []byte) []byte {
+	return slice[len(tombstonePrefix):]
+}
+
+// DropTombstones removes all the tombstones from the buffer, along with the slices written before
+// them whose key, as returned by keyOf, was deleted. Slices written after the tombstone for their
+// key are kept. The remaining slices are moved forward in place, like Compact does. With
+// WithTimestamps, the timestamps are skipped, both to tell tombstones apart and when passing the
+// slices to keyOf.
+func (b *Buffer) DropTombstones(keyOf func(slice []byte) []byte) {
+	b.mustBeWritable()
+	// Find the offset of the last tombstone for every deleted key.
+	deleted := make(map[string]int)
+	for next := b.StartOffset(); next < int(b.offset); {
+		raw := b.rawSlice(b.buf[next:])
+		if slice := b.untimed(raw); IsTombstone(slice) {
+			deleted[string(TombstoneKey(slice))] = next
+		}
+		next += len(raw)
+	}
+	if len(deleted) == 0 {
+		return
+	}
+
+	read, write := b.StartOffset(), b.StartOffset()
+	for read < int(b.offset) {
+		off, raw := read, b.rawSlice(b.buf[read:])
+		read += len(raw)
+		if slice := b.untimed(raw); IsTombstone(slice) {
+			continue
+		} else if del, ok := deleted[string(keyOf(slice))]; ok && off < del {
+			continue
+		}
+		assert(len(raw) == copy(b.buf[write:], raw))
+		write += len(raw)
+	}
+	b.offset = uint64(write)
+	b.clampReadOff()
 }
 
 func (b *Buffer) StartOffset() int {
@@ -278,22 +1536,109 @@ func (b *Buffer) WriteSlice(slice []byte) {
 }
 
 func (b *Buffer) SliceIterate(f func(slice []byte) error) error {
-	if b.IsEmpty() {
-		return nil
-	}
-	slice, next := []byte{}, b.StartOffset()
-	for next >= 0 {
-		slice, next = b.Slice(next)
+	return b.ForEach(func(slice []byte) error {
 		if len(slice) == 0 {
-			continue
+			return nil
 		}
-		if err := f(slice); err != nil {
+		return f(slice)
+	})
+}
+
+// ForEach calls fn with every slice, without its length prefix, in the order they were written,
+// stopping at the first error returned by fn. Unlike SliceIterate, empty slices are passed to fn
+// as well. The slices alias the buffer, so they're only valid until it's next written to.
+func (b *Buffer) ForEach(fn func(slice []byte) error) error {
+	for next := b.StartOffset(); next < int(b.offset); {
+		raw := b.rawSlice(b.buf[next:])
+		next += len(raw)
+		if err := fn(b.payload(raw)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// SliceIterateWithKey works like SliceIterate, but extracts the key of every slice via keyOf once,
+// and hands it to both filter and f, so an expensive key extraction isn't repeated. f is only
+// called for the slices accepted by filter. A nil filter accepts all the slices.
+func (b *Buffer) SliceIterateWithKey(keyOf func(slice []byte) []byte,
+	filter func(key, slice []byte) bool, f func(key, slice []byte) error) error {
+	return b.SliceIterate(func(slice []byte) error {
+		key := keyOf(slice)
+		if filter != nil && !filter(key, slice) {
+			return nil
+		}
+		return f(key, slice)
+	})
+}
+
+// SliceIterator iterates over the slices of a Buffer, skipping empty slices like SliceIterate:
+//
+//	it := b.NewSliceIterator()
+//	for it.Next() {
+//		use(it.Slice())
+//	}
+//
+// Like the readers from NewReader, an iterator keeps the buffer from being released. It lets go of
+// the buffer once Next returns false, or once Close is called when stopping early.
+type SliceIterator struct {
+	b      *Buffer
+	slice  []byte
+	offset int // offset of the current slice
+	next   int // offset of the next slice
+}
+
+// NewSliceIterator returns an iterator positioned before the first slice.
+func (b *Buffer) NewSliceIterator() *SliceIterator {
+	atomic.AddInt32(&b.readers, 1)
+	return &SliceIterator{b: b, next: b.StartOffset()}
+}
+
+// Next moves to the next slice, returning false once there are no more slices.
+func (it *SliceIterator) Next() bool {
+	for it.b != nil && it.next < int(it.b.offset) {
+		it.offset = it.next
+		raw := it.b.rawSlice(it.b.buf[it.offset:])
+		it.slice, it.next = it.b.payload(raw), it.offset+len(raw)
+		if len(it.slice) > 0 {
+			return true
+		}
+	}
+	it.Close()
+	return false
+}
+
+// Slice returns the current slice. It is only valid until the buffer is modified.
+func (it *SliceIterator) Slice() []byte {
+	return it.slice
+}
+
+// Offset returns the offset of the current slice, which can be passed to Slice.
+func (it *SliceIterator) Offset() int {
+	return it.offset
+}
+
+// Close lets go of the buffer. Closing an iterator more than once is a no-op.
+func (it *SliceIterator) Close() error {
+	if it.b != nil {
+		atomic.AddInt32(&it.b.readers, -1)
+		it.b, it.slice = nil, nil
+	}
+	return nil
+}
+
+// SliceIterateCopy works like SliceIterate, but copies every slice into scratch before calling f,
+// so f can safely modify the slice. The slice passed to f is only valid until f returns. scratch
+// is grown as needed, and is returned so it can be reused across calls.
+func (b *Buffer) SliceIterateCopy(scratch []byte,
+	f func(slice []byte) error) ([]byte, error) {
+	err := b.SliceIterate(func(slice []byte) error {
+		scratch = append(scratch[:0], slice...)
+		return f(scratch)
+	})
+	return scratch, err
+}
+
 const (
 	UseCalloc BufferType = iota
 	UseMmap
@@ -313,37 +1658,103 @@ func (t BufferType) String() string {
 	}
 }
 
+// String returns a summary of the buffer for debugging: its type, length without padding,
+// capacity and max size, followed by a hex and ASCII preview of at most the first
+// stringPreviewLen bytes written.
+func (b *Buffer) String() string {
+	if b == nil {
+		return "Buffer(nil)"
+	}
+	var preview []byte
+	if b.buf != nil {
+		preview = b.Bytes()
+		if len(preview) > stringPreviewLen {
+			preview = preview[:stringPreviewLen]
+		}
+	}
+	ascii := make([]byte, len(preview))
+	for i, c := range preview {
+		if c < 0x20 || c > 0x7e {
+			c = '.'
+		}
+		ascii[i] = c
+	}
+	return fmt.Sprintf("Buffer{type:%s tag:%s len:%d cap:%d max:%d preview:[% x] %q}",
+		b.bufType, b.tag, b.LenNoPadding(), b.curSz, b.maxSz, preview, ascii)
+}
+
 type LessFunc func(a, b []byte) bool
 type sortHelper struct {
+	ctx     context.Context
 	offsets []int
 	b       *Buffer
 	tmp     *Buffer
 	less    LessFunc
+	stable  bool
 	small   []int
 }
 
 func (s *sortHelper) sortSmall(start, end int) {
 	s.tmp.Reset()
 	s.small = s.small[:0]
-	next := start
-	for next >= 0 && next < end {
-		s.small = append(s.small, next)
-		_, next = s.b.Slice(next)
-	}
-
 	// We are sorting the slices pointed to by s.small offsets, but only moving the offsets around.
-	sort.Slice(s.small, func(i, j int) bool {
-		left, _ := s.b.Slice(s.small[i])
-		right, _ := s.b.Slice(s.small[j])
-		return s.less(left, right)
-	})
+	var less func(i, j int) bool
+	if w := s.b.fixedWidth; w > 0 {
+		// Records of a fixed width can be found and compared without decoding any lengths.
+		for off := start; off < end; off += w {
+			s.small = append(s.small, off)
+		}
+		less = func(i, j int) bool {
+			li, ri := s.small[i], s.small[j]
+			return s.less(s.b.buf[li:li+w], s.b.buf[ri:ri+w])
+		}
+	} else {
+		next := start
+		for next >= 0 && next < end {
+			s.small = append(s.small, next)
+			_, next = s.b.Slice(next)
+		}
+		less = func(i, j int) bool {
+			left, _ := s.b.Slice(s.small[i])
+			right, _ := s.b.Slice(s.small[j])
+			return s.less(left, right)
+		}
+	}
+	if s.stable {
+		sort.SliceStable(s.small, less)
+	} else {
+		sort.Slice(s.small, less)
+	}
 	// Now we iterate over the s.small offsets and copy over the slices. The result is now in order.
 	for _, off := range s.small {
-		s.tmp.Write(rawSlice(s.b.buf[off:]))
+		s.tmp.Write(s.b.rawSlice(s.b.buf[off:]))
 	}
 	assert(end-start == copy(s.b.buf[start:end], s.tmp.Bytes()))
 }
 
+// bufferPanic wraps the errors that Buffer panics with, so SafeBuild can tell them apart from
+// other panics.
+type bufferPanic struct {
+	error
+}
+
+// SafeBuild runs fn over b, converting any panic raised by the Buffer, like the one on exceeding
+// the max size, into the returned error. This lets code using the panicking Buffer API contain
+// those panics in one place. Panics not raised by the Buffer are propagated.
+func SafeBuild(b *Buffer, fn func(*Buffer)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			bp, ok := r.(bufferPanic)
+			if !ok {
+				panic(r)
+			}
+			err = bp.error
+		}
+	}()
+	fn(b)
+	return nil
+}
+
 func assert(b bool) {
 	if !b {
 		glog.Fatalf("%+v", errors.Errorf("Assertion failure"))
@@ -388,11 +1799,12 @@ func (s *sortHelper) merge(left, right []byte, start, end int) {
 			assert(len(left) == copy(s.b.buf[start:end], left))
 			return
 		}
-		ls = rawSlice(left)
-		rs = rawSlice(right)
+		ls = s.b.rawSlice(left)
+		rs = s.b.rawSlice(right)
 
-		// We skip the first 4 bytes in the rawSlice, because that stores the length.
-		if s.less(ls[4:], rs[4:]) {
+		// We skip the length prefix in the rawSlice. Equal slices are taken from the left first,
+		// which keeps the merge stable.
+		if !s.less(s.b.payload(rs), s.b.payload(ls)) {
 			copyLeft()
 		} else {
 			copyRight()
@@ -400,10 +1812,117 @@ func (s *sortHelper) merge(left, right []byte, start, end int) {
 	}
 }
 
-func (s *sortHelper) sort(lo, hi int) []byte {
-	assert(lo <= hi)
+// parallelSortBlocks is the least number of blocks of 1024 slices for which SortSliceParallel
+// sorts in parallel.
+const parallelSortBlocks = 8
+
+// workerPanic holds the first panic raised by the goroutines of a parallel sort, so it can be
+// raised again on the calling goroutine, instead of crashing the process.
+type workerPanic struct {
+	once sync.Once
+	val  interface{}
+}
+
+// capture must be deferred by every goroutine of the sort.
+func (p *workerPanic) capture() {
+	if r := recover(); r != nil {
+		p.once.Do(func() { p.val = r })
+	}
+}
+
+// reraise must be called once all the goroutines are done.
+func (p *workerPanic) reraise() {
+	if p.val != nil {
+		panic(p.val)
+	}
+}
+
+// fork returns a helper over the same slices, with its own scratch space, so it can be used
+// concurrently with s over a disjoint range of blocks. The returned helper must be released.
+func (s *sortHelper) fork() *sortHelper {
+	return &sortHelper{
+		ctx:     s.ctx,
+		offsets: s.offsets,
+		b:       s.b,
+		less:    s.less,
+		stable:  s.stable,
+		small:   make([]int, 0, 1024),
+		tmp:     NewBuffer(defaultCapacity, s.b.tag),
+	}
+}
+
+func (s *sortHelper) release() {
+	s.tmp.Release()
+}
+
+// sortSmallParallel runs sortSmall over all the blocks, spread across workers goroutines.
+func (s *sortHelper) sortSmallParallel(workers int) {
+	blocks := make(chan int, len(s.offsets)-1)
+	for i := 0; i < len(s.offsets)-1; i++ {
+		blocks <- i
+	}
+	close(blocks)
+
+	var wg sync.WaitGroup
+	var p workerPanic
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer p.capture()
+			h := s.fork()
+			defer h.release()
+			for i := range blocks {
+				if h.ctx.Err() != nil {
+					return
+				}
+				h.sortSmall(s.offsets[i], s.offsets[i+1])
+			}
+		}()
+	}
+	wg.Wait()
+	p.reraise()
+}
+
+// sortParallel works like sort, but sorts the left half in a new goroutine for the top depth
+// levels of the merge tree. The halves are disjoint, so they can be merged concurrently.
+func (s *sortHelper) sortParallel(lo, hi, depth int) []byte {
+	mid := lo + (hi-lo)/2
+	if depth == 0 || lo == mid {
+		return s.sort(lo, hi)
+	}
+
+	var left, right []byte
+	var wg sync.WaitGroup
+	var p workerPanic
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer p.capture()
+		h := s.fork()
+		defer h.release()
+		left = h.sortParallel(lo, mid, depth-1)
+	}()
+	// The right half is sorted on this goroutine, but must not leave the left one running if
+	// it panics.
+	func() {
+		defer p.capture()
+		right = s.sortParallel(mid, hi, depth-1)
+	}()
+	wg.Wait()
+	p.reraise()
 
-	mid := lo + (hi-lo)/2
+	loff, hoff := s.offsets[lo], s.offsets[hi]
+	if s.ctx.Err() == nil {
+		s.merge(left, right, loff, hoff)
+	}
+	return s.b.buf[loff:hoff]
+}
+
+func (s *sortHelper) sort(lo, hi int) []byte {
+	assert(lo <= hi)
+
+	mid := lo + (hi-lo)/2
 	loff, hoff := s.offsets[lo], s.offsets[hi]
 	if lo == mid {
 		// No need to sort, just return the buffer.
@@ -416,7 +1935,10 @@ func (s *sortHelper) sort(lo, hi int) []byte {
 	// contains a thousand entries. So, if we do mid+1, we'd skip over those entries.
 	right := s.sort(mid, hi)
 
-	s.merge(left, right, loff, hoff)
+	// A merge must not be stopped halfway, so cancellation is only checked before it starts.
+	if s.ctx.Err() == nil {
+		s.merge(left, right, loff, hoff)
+	}
 	return s.b.buf[loff:hoff]
 }
 
@@ -424,22 +1946,236 @@ func (s *sortHelper) sort(lo, hi int) []byte {
 func (b *Buffer) SortSlice(less func(left, right []byte) bool) {
 	b.SortSliceBetween(b.StartOffset(), int(b.offset), less)
 }
+
+// SortSliceInto writes the slices of b into dst in the order given by less, leaving b untouched.
+// dst is Reset first. Unlike SortSlice, which sorts in place, this needs enough memory in dst for
+// a second copy of all the slices, plus an offset per slice for sorting. The slices are copied
+// over along with their framing, so it panics if dst doesn't frame its slices like b. If dst is b
+// itself, it sorts b in place via SortSliceStable instead.
+func (b *Buffer) SortSliceInto(dst *Buffer, less LessFunc) {
+	if dst == b {
+		// Resetting dst would drop the slices before they're copied over.
+		b.SortSliceStable(less)
+		return
+	}
+	if !b.sameFraming(dst) {
+		panic(bufferPanic{errors.New("cannot sort into a buffer with different slice framing")})
+	}
+	dst.Reset()
+	if b.IsEmpty() {
+		return
+	}
+	offsets := b.SliceOffsets()
+	sort.SliceStable(offsets, func(i, j int) bool {
+		left, _ := b.Slice(offsets[i])
+		right, _ := b.Slice(offsets[j])
+		return less(left, right)
+	})
+	dst.Grow(b.LenNoPadding())
+	for _, off := range offsets {
+		raw := b.rawSlice(b.buf[off:])
+		copy(dst.Allocate(len(raw)), raw)
+	}
+}
+
+// IsSorted returns whether the slices are sorted according to less.
+func (b *Buffer) IsSorted(less LessFunc) bool {
+	return b.isSortedBetween(b.StartOffset(), int(b.offset), less)
+}
+
+func (b *Buffer) isSortedBetween(start, end int, less LessFunc) bool {
+	var prev []byte
+	for next := start; next >= 0 && next < end; {
+		var cur []byte
+		cur, next = b.Slice(next)
+		if prev != nil && less(cur, prev) {
+			return false
+		}
+		prev = cur
+	}
+	return true
+}
+
+// SortSliceByUint64Prefix sorts the slices by the big-endian uint64 stored in their first 8 bytes.
+// It returns an error, without sorting, if any of the slices is shorter than 8 bytes.
+func (b *Buffer) SortSliceByUint64Prefix() error {
+	for next := b.StartOffset(); next < int(b.offset); {
+		raw := b.rawSlice(b.buf[next:])
+		if len(b.payload(raw)) < 8 {
+			return errors.Errorf("slice at offset %d is shorter than 8 bytes", next)
+		}
+		next += len(raw)
+	}
+	b.SortSlice(func(left, right []byte) bool {
+		return binary.BigEndian.Uint64(left) < binary.BigEndian.Uint64(right)
+	})
+	return nil
+}
+
+// RadixSortUint64Prefix sorts the slices by the big-endian uint64 stored in their first 8 bytes,
+// like SortSliceByUint64Prefix, but using an LSD radix sort which is O(n) in the number of slices.
+// It's the same as SortSliceRadix(8).
+func (b *Buffer) RadixSortUint64Prefix() {
+	b.SortSliceRadix(8)
+}
+
+// SortSliceRadix sorts the slices by their first keyWidth bytes, compared byte-wise, e.g. by
+// big-endian integers of keyWidth bytes. It uses an LSD radix sort, with one pass per key byte,
+// which is O(n) in the number of slices, and much faster than SortSlice for short keys. The sort is
+// stable. If any of the slices is shorter than keyWidth, it falls back to SortSliceStable,
+// ordering the slices by their first keyWidth bytes, or less if they're shorter.
+func (b *Buffer) SortSliceRadix(keyWidth int) {
+	b.mustBeWritable()
+	if keyWidth <= 0 {
+		panic(bufferPanic{errors.Errorf("invalid radix sort key width: %d", keyWidth)})
+	}
+	type entry struct {
+		offset int    // of the slice, length prefix included
+		key    int    // offset of the key, i.e. the payload
+		digits uint64 // up to 8 bytes of the key, for the passes in progress
+	}
+	var entries []entry
+	for next := b.StartOffset(); next < int(b.offset); {
+		raw := b.rawSlice(b.buf[next:])
+		payload := b.payload(raw)
+		if len(payload) < keyWidth {
+			b.SortSliceStable(func(left, right []byte) bool {
+				return bytes.Compare(keyPrefix(left, keyWidth), keyPrefix(right, keyWidth)) < 0
+			})
+			return
+		}
+		entries = append(entries, entry{offset: next, key: next + len(raw) - len(payload)})
+		next += len(raw)
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	tmp := make([]entry, len(entries))
+	// Go over the key 8 bytes at a time, starting from the least significant ones. Loading them into
+	// the entries first saves the passes from reading the buffer at random.
+	for hi := keyWidth; hi > 0; hi -= 8 {
+		lo := hi - 8
+		if lo < 0 {
+			lo = 0
+		}
+		for i := range entries {
+			var digits uint64
+			for _, c := range b.buf[entries[i].key+lo : entries[i].key+hi] {
+				digits = digits<<8 | uint64(c)
+			}
+			entries[i].digits = digits
+		}
+		for shift := uint(0); shift < uint(8*(hi-lo)); shift += 8 {
+			var counts [256]int
+			for _, e := range entries {
+				counts[byte(e.digits>>shift)]++
+			}
+			// All the keys share this byte, so this pass wouldn't move anything.
+			if counts[byte(entries[0].digits>>shift)] == len(entries) {
+				continue
+			}
+			pos := 0
+			for i, c := range counts {
+				counts[i] = pos
+				pos += c
+			}
+			for _, e := range entries {
+				d := byte(e.digits >> shift)
+				tmp[counts[d]] = e
+				counts[d]++
+			}
+			entries, tmp = tmp, entries
+		}
+	}
+
+	start := b.StartOffset()
+	sorted := callocBuffer(int(b.offset)-start, b.tag)
+	defer freeBuffer(sorted, b.tag)
+	n := 0
+	for _, e := range entries {
+		n += copy(sorted[n:], b.rawSlice(b.buf[e.offset:]))
+	}
+	copy(b.buf[start:], sorted)
+}
+
+// keyPrefix returns the first width bytes of slice, or all of it if it's shorter.
+func keyPrefix(slice []byte, width int) []byte {
+	if len(slice) > width {
+		return slice[:width]
+	}
+	return slice
+}
+
 func (b *Buffer) SortSliceBetween(start, end int, less LessFunc) {
+	_ = b.sortSliceBetween(context.Background(), start, end, less, false, 1)
+}
+
+// SortSliceParallel works like SortSlice, but sorts the blocks of 1024 slices, and merges them,
+// from the given number of goroutines. Buffers of fewer than 8 blocks are sorted serially. If
+// workers is not positive, GOMAXPROCS goroutines are used. Note that less MUST be safe for
+// concurrent calls. If less panics, the panic is raised again on the calling goroutine once all
+// the goroutines are done, leaving the buffer partially sorted.
+func (b *Buffer) SortSliceParallel(less LessFunc, workers int) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	_ = b.sortSliceBetween(context.Background(), b.StartOffset(), int(b.offset), less, false,
+		workers)
+}
+
+// SortSliceContext works like SortSlice, but stops early, returning ctx.Err(), once ctx is done.
+// The cancellation is checked for between sorting every block of 1024 slices, and before every
+// merge of sorted blocks. If the sort is stopped early, the buffer is left partially sorted, but
+// all of its slices are intact.
+func (b *Buffer) SortSliceContext(ctx context.Context, less LessFunc) error {
+	return b.sortSliceBetween(ctx, b.StartOffset(), int(b.offset), less, false, 1)
+}
+
+// SortSliceDesc works like SortSlice, but sorts the slices in descending order of less, which is
+// the comparator for ascending order. Like for SortSlice, less is only passed the slices, without
+// their length prefixes.
+func (b *Buffer) SortSliceDesc(less LessFunc) {
+	b.SortSlice(func(left, right []byte) bool {
+		return less(right, left)
+	})
+}
+
+// SortSliceStable works like SortSlice, but keeps the slices which are equal according to less in
+// the order they were written in.
+func (b *Buffer) SortSliceStable(less LessFunc) {
+	_ = b.sortSliceBetween(context.Background(), b.StartOffset(), int(b.offset), less, true, 1)
+}
+
+func (b *Buffer) sortSliceBetween(ctx context.Context, start, end int, less LessFunc,
+	stable bool, workers int) error {
+	b.mustBeWritable()
 	if start >= end {
-		return
+		return nil
 	}
-	if start == 0 {
-		panic("start can never be zero")
+	if start < b.StartOffset() {
+		panic(bufferPanic{errors.New("start can never be within the padding")})
+	}
+	// This is cheap compared to sorting, and makes sorting already ordered data nearly free.
+	if b.isSortedBetween(start, end, less) {
+		return nil
 	}
 
 	var offsets []int
-	next, count := start, 0
-	for next >= 0 && next < end {
-		if count%1024 == 0 {
+	if b.fixedWidth > 0 {
+		// The blocks can be found without walking the records.
+		for next := start; next < end; next += 1024 * b.fixedWidth {
 			offsets = append(offsets, next)
 		}
-		_, next = b.Slice(next)
-		count++
+	} else {
+		next, count := start, 0
+		for next >= 0 && next < end {
+			if count%1024 == 0 {
+				offsets = append(offsets, next)
+			}
+			_, next = b.Slice(next)
+			count++
+		}
 	}
 	assert(len(offsets) > 0)
 	if offsets[len(offsets)-1] != end {
@@ -448,36 +2184,130 @@ func (b *Buffer) SortSliceBetween(start, end int, less LessFunc) {
 
 	szTmp := int(float64((end-start)/2) * 1.1)
 	s := &sortHelper{
+		ctx:     ctx,
 		offsets: offsets,
 		b:       b,
 		less:    less,
+		stable:  stable,
 		small:   make([]int, 0, 1024),
 		tmp:     NewBuffer(szTmp, b.tag),
 	}
 	defer s.tmp.Release()
 
+	// The blocks get sorted one after the other, so let the kernel read ahead. The advice is only a
+	// hint, hence errors are ignored.
+	if b.bufType == UseMmap {
+		_ = b.Advise(AdviseSequential)
+		defer func() { _ = b.Advise(AdviseNormal) }()
+	}
+
+	// Sort the blocks of 1024 slices, and then merge them, in parallel if asked to for big buffers.
+	if workers > 1 && len(offsets)-1 >= parallelSortBlocks {
+		s.sortSmallParallel(workers)
+		depth := 0
+		for 1<<uint(depth) < workers {
+			depth++
+		}
+		s.sortParallel(0, len(offsets)-1, depth)
+		return ctx.Err()
+	}
 	left := offsets[0]
 	for _, off := range offsets[1:] {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		s.sortSmall(left, off)
 		left = off
 	}
 	s.sort(0, len(offsets)-1)
+	return ctx.Err()
+}
+
+// readLen decodes the length prefix of the slice starting at buf, returning its size, and the
+// number of bytes taken up by the prefix.
+func (b *Buffer) readLen(buf []byte) (sz, n int) {
+	if b.fixedWidth > 0 {
+		return b.fixedWidth, 0
+	}
+	if b.varintLen {
+		v, n := binary.Uvarint(buf)
+		return int(v), n
+	}
+	if b.wideLen {
+		return int(binary.BigEndian.Uint64(buf)), 8
+	}
+	return int(binary.BigEndian.Uint32(buf)), 4
+}
+
+// putLen encodes sz as a length prefix into buf, returning the number of bytes written.
+func (b *Buffer) putLen(buf []byte, sz int) int {
+	if b.fixedWidth > 0 {
+		if sz != b.fixedWidth {
+			panic(bufferPanic{errors.Errorf("slice size: %d doesn't match record width: %d",
+				sz, b.fixedWidth)})
+		}
+		return 0
+	}
+	if b.varintLen {
+		return binary.PutUvarint(buf, uint64(sz))
+	}
+	if b.wideLen {
+		binary.BigEndian.PutUint64(buf, uint64(sz))
+		return 8
+	}
+	binary.BigEndian.PutUint32(buf, uint32(sz))
+	return 4
+}
+
+// lenSize returns the number of bytes taken up by the length prefix of a slice of size sz.
+func (b *Buffer) lenSize(sz int) int {
+	if b.fixedWidth > 0 {
+		return 0
+	}
+	if b.wideLen {
+		return 8
+	}
+	if !b.varintLen {
+		return 4
+	}
+	n := 1
+	for v := uint64(sz); v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// rawSlice returns the slice starting at buf, length prefix included.
+func (b *Buffer) rawSlice(buf []byte) []byte {
+	sz, n := b.readLen(buf)
+	return buf[:n+sz]
+}
+
+// payload strips the length prefix from a slice returned by rawSlice.
+func (b *Buffer) payload(raw []byte) []byte {
+	_, n := b.readLen(raw)
+	return raw[n:]
 }
 
-func rawSlice(buf []byte) []byte {
-	sz := binary.BigEndian.Uint32(buf)
-	return buf[:4+int(sz)]
+// untimed works like payload, but also strips the timestamp written with WithTimestamps.
+func (b *Buffer) untimed(raw []byte) []byte {
+	slice := b.payload(raw)
+	if b.timestamps {
+		return slice[timestampSize:]
+	}
+	return slice
 }
 
-// Slice would return the slice written at offset.
+// Slice would return the slice written at offset. Like Data, the slice aliases the buffer, see
+// DetachSlice for a copy.
 func (b *Buffer) Slice(offset int) ([]byte, int) {
 	if offset >= int(b.offset) {
 		return nil, -1
 	}
 
-	sz := binary.BigEndian.Uint32(b.buf[offset:])
-	start := offset + 4
-	next := start + int(sz)
+	sz, n := b.readLen(b.buf[offset:])
+	start := offset + n
+	next := start + sz
 	res := b.buf[start:next]
 	if next >= int(b.offset) {
 		next = -1
@@ -485,6 +2315,253 @@ func (b *Buffer) Slice(offset int) ([]byte, int) {
 	return res, next
 }
 
+// Deduplicate removes the slices which are equal to the slice preceding them, keeping the first
+// slice of every run. It assumes that the buffer is sorted (e.g. via SortSlice), so that the
+// duplicates are adjacent. The remaining slices are moved forward in place, and the offset is
+// updated to the new end of the buffer.
+func (b *Buffer) Deduplicate(equal func(a, b []byte) bool) {
+	b.mustBeWritable()
+	var last []byte
+	var haveLast bool
+	read, write := b.StartOffset(), b.StartOffset()
+	for read < int(b.offset) {
+		raw := b.rawSlice(b.buf[read:])
+		read += len(raw)
+		if haveLast && equal(last, b.payload(raw)) {
+			continue
+		}
+		assert(len(raw) == copy(b.buf[write:], raw))
+		last = b.payload(b.buf[write : write+len(raw)])
+		haveLast = true
+		write += len(raw)
+	}
+	b.offset = uint64(write)
+	b.clampReadOff()
+}
+
+// Compact removes the slices for which keep returns false. The remaining slices are moved forward
+// in place, preserving their order, and the offset is updated to the new end of the buffer.
+func (b *Buffer) Compact(keep func(slice []byte) bool) {
+	b.mustBeWritable()
+	read, write := b.StartOffset(), b.StartOffset()
+	for read < int(b.offset) {
+		raw := b.rawSlice(b.buf[read:])
+		read += len(raw)
+		if !keep(b.payload(raw)) {
+			continue
+		}
+		assert(len(raw) == copy(b.buf[write:], raw))
+		write += len(raw)
+	}
+	b.offset = uint64(write)
+	b.clampReadOff()
+}
+
+// CompactAndTruncate works like Compact, followed by ShrinkToFit.
+func (b *Buffer) CompactAndTruncate(keep func(slice []byte) bool) error {
+	b.Compact(keep)
+	return b.ShrinkToFit()
+}
+
+// ShrinkToFit truncates the backing file of an UseMmap buffer down to the pages used by the bytes
+// written, e.g. after Compact or Deduplicate dropped slices, giving the disk space back. It's a
+// no-op for other buffers. Use Shrink to also give back the memory of UseCalloc buffers.
+func (b *Buffer) ShrinkToFit() error {
+	if b.bufType != UseMmap {
+		return nil
+	}
+	return b.Shrink()
+}
+
+// Shrink gives back the capacity over-allocated beyond the bytes written, e.g. after a spike that
+// was drained by Reset, Compact or Deduplicate. For UseCalloc, if the buffer is at least twice the
+// size needed, it reallocates a smaller region holding offset rounded up to a page, copies the data
+// over and frees the old one. For UseMmap, the backing file is truncated down to offset rounded up
+// to a page, and the mapping is shrunk to match, which gives up a mapping reserved beyond the file
+// via ReserveMapping. It's a no-op for other buffers.
+func (b *Buffer) Shrink() error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	sz := int(b.offset)
+	if rem := sz % pageSize; rem != 0 {
+		sz += pageSize - rem
+	}
+	if sz < defaultCapacity {
+		sz = defaultCapacity
+	}
+
+	switch b.bufType {
+	case UseCalloc:
+		if b.curSz < 2*sz {
+			return nil
+		}
+		if b.grown {
+			b.noteGrowShrinkCycle()
+		}
+		buf := callocBuffer(sz, b.tag)
+		copy(buf, b.buf[:b.offset])
+		freeBuffer(b.buf, b.tag)
+		b.buf = buf
+	case UseMmap:
+		if sz >= b.curSz {
+			return nil
+		}
+		if err := b.mmapFile.Truncate(int64(sz)); err != nil {
+			return errors.Wrapf(err,
+				"while trying to truncate file: %s to size: %d", b.mmapFile.Fd.Name(), sz)
+		}
+		if b.grown {
+			b.noteGrowShrinkCycle()
+		}
+		b.buf = b.mmapFile.Data
+	default:
+		return nil
+	}
+	b.curSz = sz
+	return nil
+}
+
+// CompactParallel works like Compact, but runs keep over the slices from the given number of
+// goroutines, each handling a contiguous chunk of them. Once all the decisions are made, the kept
+// slices are moved forward serially, preserving their order. If workers is not positive,
+// GOMAXPROCS goroutines are used. Note that keep MUST be safe for concurrent calls.
+func (b *Buffer) CompactParallel(keep func(slice []byte) bool, workers int) {
+	b.mustBeWritable()
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var offsets []int
+	for next := b.StartOffset(); next < int(b.offset); {
+		offsets = append(offsets, next)
+		next += len(b.rawSlice(b.buf[next:]))
+	}
+
+	keeps := make([]bool, len(offsets))
+	chunk := (len(offsets) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for lo := 0; lo < len(offsets); lo += chunk {
+		hi := lo + chunk
+		if hi > len(offsets) {
+			hi = len(offsets)
+		}
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			for i := lo; i < hi; i++ {
+				keeps[i] = keep(b.payload(b.rawSlice(b.buf[offsets[i]:])))
+			}
+		}(lo, hi)
+	}
+	wg.Wait()
+
+	write := b.StartOffset()
+	for i, off := range offsets {
+		if !keeps[i] {
+			continue
+		}
+		raw := b.rawSlice(b.buf[off:])
+		assert(len(raw) == copy(b.buf[write:], raw))
+		write += len(raw)
+	}
+	b.offset = uint64(write)
+	b.clampReadOff()
+}
+
+// DetachSlice returns a copy of the slice written at offset. Unlike the slice returned by Slice,
+// the copy doesn't alias the buffer, so it can be held on to after the buffer is modified or
+// released, without keeping the whole buffer's memory alive.
+func (b *Buffer) DetachSlice(offset int) []byte {
+	slice, _ := b.Slice(offset)
+	out := make([]byte, len(slice))
+	copy(out, slice)
+	return out
+}
+
+// Upsert writes value into a buffer sorted by less over the keys returned by keyOf, replacing
+// the slice with the same key if there is one. The position is found by a binary search over the
+// slice offsets, which still need an O(n) scan to collect. A value of the same size as the
+// existing one is overwritten in place. Otherwise, all the slices after the position are shifted
+// to make room, which is O(n) in the number of bytes moved. So, this is meant for small buffers
+// used as ordered maps. It isn't supported with WithTimestamps.
+func (b *Buffer) Upsert(key, value []byte, keyOf func([]byte) []byte, less LessFunc) {
+	b.mustBeWritable()
+	if b.timestamps {
+		panic(bufferPanic{errors.New("Upsert is not supported with timestamps")})
+	}
+	var offsets []int
+	if !b.IsEmpty() {
+		offsets = b.SliceOffsets()
+	}
+	i := sort.Search(len(offsets), func(i int) bool {
+		slice, _ := b.Slice(offsets[i])
+		return !less(keyOf(slice), key)
+	})
+
+	pos, oldSz := int(b.offset), 0
+	if i < len(offsets) {
+		pos = offsets[i]
+		if slice, _ := b.Slice(pos); !less(key, keyOf(slice)) {
+			if len(slice) == len(value) {
+				copy(slice, value)
+				return
+			}
+			oldSz = b.lenSize(len(slice)) + len(slice)
+		}
+	}
+
+	newSz := b.lenSize(len(value)) + len(value)
+	if newSz > oldSz {
+		b.Grow(newSz - oldSz)
+	}
+	copy(b.buf[pos+newSz:], b.buf[pos+oldSz:b.offset])
+	b.offset = uint64(int(b.offset) + newSz - oldSz)
+	b.clampReadOff()
+	n := b.putLen(b.buf[pos:], len(value))
+	copy(b.buf[pos+n:], value)
+}
+
+// NumSlices returns the number of slices written to the buffer, empty slices included. It scans
+// the length prefixes when called, so it's O(n) in the number of slices, unless WithFixedWidth is
+// used.
+func (b *Buffer) NumSlices() int {
+	if b.fixedWidth > 0 {
+		return b.LenNoPadding() / b.fixedWidth
+	}
+	var count int
+	for next := b.StartOffset(); next < int(b.offset); count++ {
+		next += len(b.rawSlice(b.buf[next:]))
+	}
+	return count
+}
+
+// BuildIndex returns the offsets of all the slices, empty slices included, in order. Like
+// SliceOffsets, it needs to scan the whole buffer. The index can be passed to Search for as long as
+// the buffer isn't modified.
+func (b *Buffer) BuildIndex() []int {
+	index := make([]int, 0, 64)
+	for next := b.StartOffset(); next < int(b.offset); {
+		index = append(index, next)
+		next += len(b.rawSlice(b.buf[next:]))
+	}
+	return index
+}
+
+// Search binary searches a buffer sorted by less, via an index returned by BuildIndex, for the
+// first slice which isn't less than target. It returns the offset of that slice, and whether it's
+// equal to target. If all the slices are less than target, the offset is the end of the buffer.
+func (b *Buffer) Search(index []int, target []byte, less LessFunc) (offset int, found bool) {
+	i := sort.Search(len(index), func(i int) bool {
+		slice, _ := b.Slice(index[i])
+		return !less(slice, target)
+	})
+	if i == len(index) {
+		return int(b.offset), false
+	}
+	slice, _ := b.Slice(index[i])
+	return index[i], !less(target, slice)
+}
+
 // SliceOffsets is an expensive function. Use sparingly.
 func (b *Buffer) SliceOffsets() []int {
 	next := b.StartOffset()
@@ -496,15 +2573,35 @@ func (b *Buffer) SliceOffsets() []int {
 	return offsets
 }
 
+// Data returns the memory of the buffer from offset up to its capacity, without copying it. The
+// returned slice aliases the buffer: a Grow which reallocates leaves it pointing to the old memory,
+// which may be freed, writes to the buffer change it, and it must not be used after Release. Use
+// ReadAtCopy to get bytes which stay valid across buffer operations.
 func (b *Buffer) Data(offset int) []byte {
 	if offset > b.curSz {
-		panic("offset beyond current size")
+		panic(bufferPanic{errors.New("offset beyond current size")})
 	}
 	return b.buf[offset:b.curSz]
 }
 
+// ReadAtCopy returns a copy of the n bytes written at offset. Unlike Data, the returned bytes don't
+// alias the buffer, so they stay valid after the buffer grows, is written to or released. It
+// returns an error if the range is not within the bytes written.
+func (b *Buffer) ReadAtCopy(n, offset int) ([]byte, error) {
+	if n < 0 || offset < b.StartOffset() || offset+n > int(b.offset) {
+		return nil, errors.Errorf("z.Buffer ReadAtCopy offset: %d len: %d out of range [%d, %d)",
+			offset, n, b.StartOffset(), b.offset)
+	}
+	out := make([]byte, n)
+	copy(out, b.buf[offset:])
+	return out, nil
+}
+
 // Write would write p bytes to the buffer.
 func (b *Buffer) Write(p []byte) (n int, err error) {
+	if err := b.checkWritable(); err != nil {
+		return 0, err
+	}
 	n = len(p)
 	b.Grow(n)
 	assert(n == copy(b.buf[b.offset:], p))
@@ -512,33 +2609,576 @@ func (b *Buffer) Write(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// WriteUint32 appends v to the buffer in big-endian order, like the length prefixes of slices.
+func (b *Buffer) WriteUint32(v uint32) {
+	binary.BigEndian.PutUint32(b.Allocate(4), v)
+}
+
+// WriteUint64 appends v to the buffer in big-endian order.
+func (b *Buffer) WriteUint64(v uint64) {
+	binary.BigEndian.PutUint64(b.Allocate(8), v)
+}
+
+// WriteUvarint appends v to the buffer as a uvarint, and returns the number of bytes written.
+func (b *Buffer) WriteUvarint(v uint64) int {
+	b.Grow(binary.MaxVarintLen64)
+	n := binary.PutUvarint(b.buf[b.offset:], v)
+	b.offset += uint64(n)
+	return n
+}
+
+// ReadUint32At returns the big-endian uint32 written at offset, e.g. by WriteUint32. It panics if
+// the 4 bytes are not within the bytes written.
+func (b *Buffer) ReadUint32At(offset int) uint32 {
+	return binary.BigEndian.Uint32(b.written(offset, 4))
+}
+
+// ReadUint64At returns the big-endian uint64 written at offset, e.g. by WriteUint64. It panics if
+// the 8 bytes are not within the bytes written.
+func (b *Buffer) ReadUint64At(offset int) uint64 {
+	return binary.BigEndian.Uint64(b.written(offset, 8))
+}
+
+// ReadUvarintAt returns the uvarint written at offset, e.g. by WriteUvarint, and the number of
+// bytes it took up. It panics if offset is not within the bytes written, or if the uvarint is
+// malformed or runs past them.
+func (b *Buffer) ReadUvarintAt(offset int) (uint64, int) {
+	v, n := binary.Uvarint(b.written(offset, 0))
+	if n <= 0 {
+		panic(bufferPanic{errors.Errorf("invalid uvarint at offset: %d", offset)})
+	}
+	return v, n
+}
+
+// written returns the bytes written from offset onwards, checking that at least n of them are.
+func (b *Buffer) written(offset, n int) []byte {
+	if offset < b.StartOffset() || offset+n > int(b.offset) {
+		panic(bufferPanic{errors.Errorf("z.Buffer read offset: %d len: %d out of range [%d, %d)",
+			offset, n, b.StartOffset(), b.offset)})
+	}
+	return b.buf[offset:b.offset]
+}
+
+// Read implements io.Reader, reading the bytes written to the buffer, padding excluded, from the
+// read cursor onwards. It returns io.EOF once the cursor reaches the end of the written bytes, but
+// picks up any bytes written afterwards. Read and Write must not be called concurrently.
+func (b *Buffer) Read(p []byte) (int, error) {
+	start := b.StartOffset() + b.readOff
+	if start >= int(b.offset) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.buf[start:b.offset])
+	b.readOff += n
+	return n, nil
+}
+
+// SeekRead moves the read cursor used by Read to offset, relative to the start of the written
+// bytes. SeekRead(0) rewinds the buffer to be read again from the start.
+func (b *Buffer) SeekRead(offset int) error {
+	if offset < 0 || offset > b.LenNoPadding() {
+		return errors.Errorf("read offset %d out of range [0, %d]", offset, b.LenNoPadding())
+	}
+	b.readOff = offset
+	return nil
+}
+
+// ReadFrom implements io.ReaderFrom, appending the bytes read from r to the buffer until r returns
+// io.EOF. Room for at least 64KB is made before every read, so the buffer doesn't grow in small
+// steps. If the buffer has a max size and r holds more than fits, it returns an error instead of
+// panicking, keeping the bytes which fit.
+func (b *Buffer) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		want := readChunkSize
+		if b.maxSz > 0 && b.maxSz-int(b.offset) < want {
+			want = b.maxSz - int(b.offset)
+		}
+		if want <= 0 {
+			// Find out whether r is done, or holds more than fits in the buffer.
+			var probe [1]byte
+			if _, err := io.ReadFull(r, probe[:]); err == io.EOF {
+				return total, nil
+			} else if err != nil {
+				return total, err
+			}
+			return total, &MaxSizeError{MaxSize: b.maxSz, Offset: int(b.offset), N: 1}
+		}
+		if err := b.grow(want); err != nil {
+			return total, err
+		}
+		// Read into all of the free capacity, which may be more than we asked for.
+		limit := b.curSz
+		if b.maxSz > 0 && b.maxSz < limit {
+			limit = b.maxSz
+		}
+		n, err := r.Read(b.buf[b.offset:limit])
+		b.offset += uint64(n)
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+// BufferReader reads the bytes written to a Buffer, via its own read cursor. It must be closed once
+// done, as the buffer refuses to be released while it has outstanding readers.
+type BufferReader struct {
+	b   *Buffer
+	off int
+}
+
+// NewReader returns a reader over the bytes written to the buffer, padding excluded, starting from
+// the beginning. Like Read, it picks up bytes written after it returned io.EOF. The reader must not
+// be used concurrently with writes to the buffer.
+func (b *Buffer) NewReader() *BufferReader {
+	atomic.AddInt32(&b.readers, 1)
+	return &BufferReader{b: b, off: b.StartOffset()}
+}
+
+// Read implements io.Reader.
+func (r *BufferReader) Read(p []byte) (int, error) {
+	if r.b == nil {
+		return 0, errors.New("read from closed z.BufferReader")
+	}
+	if r.off >= int(r.b.offset) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b.buf[r.off:r.b.offset])
+	r.off += n
+	return n, nil
+}
+
+// Close detaches the reader from the buffer. Closing a reader more than once is a no-op.
+func (r *BufferReader) Close() error {
+	if r.b != nil {
+		atomic.AddInt32(&r.b.readers, -1)
+		r.b = nil
+	}
+	return nil
+}
+
+// sameFraming returns whether other frames its slices like b, so raw slices can be copied over.
+func (b *Buffer) sameFraming(other *Buffer) bool {
+	return b.varintLen == other.varintLen && b.wideLen == other.wideLen &&
+		b.fixedWidth == other.fixedWidth && b.timestamps == other.timestamps
+}
+
+// Merge appends the bytes written to other onto the buffer, so merging buffers of slices gives a
+// buffer with the slices of both, in order. It returns an error, leaving the buffer untouched, if
+// the result would exceed the max size, or if the buffers don't frame their slices the same way.
+func (b *Buffer) Merge(other *Buffer) error {
+	if other.IsEmpty() {
+		return nil
+	}
+	if !b.sameFraming(other) {
+		return errors.New("cannot merge buffers with different slice framing")
+	}
+	// Grow first, as other may be b itself, whose bytes move when it grows.
+	if err := b.grow(other.LenNoPadding()); err != nil {
+		return err
+	}
+	b.offset += uint64(copy(b.buf[b.offset:], other.Bytes()))
+	return nil
+}
+
+// WriteBounded works like Write, but only writes as many bytes of p as fit within the max size
+// of the buffer, instead of panicking. If p had to be cut short, io.ErrShortWrite is returned
+// along with the number of bytes written.
+func (b *Buffer) WriteBounded(p []byte) (int, error) {
+	n := len(p)
+	if b.maxSz > 0 && int(b.offset)+n > b.maxSz {
+		n = b.maxSz - int(b.offset)
+		if n < 0 {
+			n = 0
+		}
+	}
+	if err := b.grow(n); err != nil {
+		return 0, err
+	}
+	assert(n == copy(b.buf[b.offset:], p[:n]))
+	b.offset += uint64(n)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// WriteAt writes p at the given offset, within the current capacity of the buffer. It returns an
+// error if p doesn't fit, or if it would overwrite the padding. The length of the buffer is not
+// changed.
+func (b *Buffer) WriteAt(p []byte, off int64) (int, error) {
+	if err := b.checkWritable(); err != nil {
+		return 0, err
+	}
+	if off < int64(b.StartOffset()) || off+int64(len(p)) > int64(b.curSz) {
+		return 0, errors.Errorf("z.Buffer WriteAt offset: %d len: %d out of range [%d, %d)",
+			off, len(p), b.StartOffset(), b.curSz)
+	}
+	n := copy(b.buf[off:], p)
+	if b.syncWriteAt && b.bufType == UseMmap && n > 0 {
+		// msync needs a page aligned start address.
+		start := off &^ int64(os.Getpagesize()-1)
+		if err := Msync(b.buf[start : off+int64(n)]); err != nil {
+			return n, errors.Wrapf(err, "while syncing written range")
+		}
+	}
+	return n, nil
+}
+
+// WriteAtGrow works like WriteAt, but grows the buffer to fit p at off, within the max size if one
+// is set, instead of returning an error. If p ends beyond the bytes written so far, the length of
+// the buffer is extended to its end, so Bytes includes it. Any gap between the previous end and off
+// is zeroed. This allows using the buffer as a sparse random-access byte store. Writing within the
+// padding returns an error.
+func (b *Buffer) WriteAtGrow(p []byte, off int) (int, error) {
+	if off < b.StartOffset() {
+		return 0, errors.Errorf("z.Buffer WriteAtGrow offset: %d within the padding of %d",
+			off, b.StartOffset())
+	}
+	end := off + len(p)
+	n := end - int(b.offset)
+	if n < 0 {
+		n = 0
+	}
+	if err := b.grow(n); err != nil {
+		return 0, err
+	}
+	if off > int(b.offset) {
+		zero(b.buf[b.offset:off])
+	}
+	copy(b.buf[off:], p)
+	if end > int(b.offset) {
+		b.offset = uint64(end)
+	}
+	return len(p), nil
+}
+
+// Sync flushes the bytes written to an UseMmap buffer to its backing file via msync, so they
+// survive a crash. This matters for buffers created via NewBufferPersistent, which are used as
+// storage rather than scratch space. It's a no-op for other buffers.
+func (b *Buffer) Sync() error {
+	if b.bufType != UseMmap || b.mmapFile == nil {
+		return nil
+	}
+	if err := Msync(b.buf[:b.offset]); err != nil {
+		return errors.Wrapf(err, "while syncing file: %s", b.mmapFile.Fd.Name())
+	}
+	return nil
+}
+
+// checksumMagic ends the trailer appended by WriteChecksum, after the CRC32 of the bytes before it.
+const checksumMagic = "zcrc"
+
+// WriteChecksum appends a trailer holding a CRC32 (Castagnoli) of the bytes written so far, and a
+// magic marker, so that silent corruption of a persisted buffer can be detected when reopening it
+// via VerifyChecksum. The trailer is not a slice, so this must be the last write before the buffer
+// is persisted, e.g. via Sync or ReleaseKeepFile.
+func (b *Buffer) WriteChecksum() {
+	crc := crc32.Checksum(b.Bytes(), crcTable)
+	trailer := b.Allocate(4 + len(checksumMagic))
+	binary.BigEndian.PutUint32(trailer, crc)
+	copy(trailer[4:], checksumMagic)
+}
+
+// VerifyChecksum checks the trailer appended by WriteChecksum against the bytes before it, e.g.
+// after reopening the buffer via NewBufferReadOnly. If they match, it drops the trailer from the
+// length of the buffer, so the slices can be read as before, and returns true. Otherwise, including
+// if there's no trailer, it returns false and leaves the buffer untouched.
+func (b *Buffer) VerifyChecksum() bool {
+	data := b.Bytes()
+	end := len(data) - 4 - len(checksumMagic)
+	if end < 0 || string(data[end+4:]) != checksumMagic {
+		return false
+	}
+	if crc32.Checksum(data[:end], crcTable) != binary.BigEndian.Uint32(data[end:]) {
+		return false
+	}
+	b.offset = uint64(b.StartOffset() + end)
+	b.clampReadOff()
+	return true
+}
+
+// WriteTo implements io.WriterTo, writing the bytes written to the buffer from the read cursor
+// onwards, i.e. all of Bytes for a buffer which wasn't read from. It writes in chunks of 1MB, so
+// the pages of a big UseMmap buffer don't all need to be faulted in at once. Like Read, it moves
+// the read cursor past the bytes written, which lets io.Copy use it in place of Read. The error
+// returned by w, if any, is returned as is.
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	start := b.StartOffset() + b.readOff
+	if start >= int(b.offset) {
+		return 0, nil
+	}
+	n, err := writeChunks(w, b.buf[start:b.offset])
+	b.readOff += int(n)
+	return n, err
+}
+
+// writeChunks streams data to w, in chunks of at most writeChunkSize bytes.
+func writeChunks(w io.Writer, data []byte) (int64, error) {
+	var written int64
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > writeChunkSize {
+			chunk = chunk[:writeChunkSize]
+		}
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// WriteToBySlices writes the framed slices to w, length prefixes included, grouping
+// recordsPerWrite slices into every Write call. Unlike writing Bytes, a slice is never split across
+// two writes, so w can hand each write to a sink which expects whole records.
+func (b *Buffer) WriteToBySlices(w io.Writer, recordsPerWrite int) (int64, error) {
+	if recordsPerWrite < 1 {
+		recordsPerWrite = 1
+	}
+	var written int64
+	start, end := b.StartOffset(), b.StartOffset()
+	for records := 0; start < int(b.offset); records = 0 {
+		for ; records < recordsPerWrite && end < int(b.offset); records++ {
+			end += len(b.rawSlice(b.buf[end:]))
+		}
+		n, err := w.Write(b.buf[start:end])
+		written += int64(n)
+		if err == nil && n < end-start {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return written, err
+		}
+		start = end
+	}
+	return written, nil
+}
+
+// PipeThrough streams the written bytes through the writer returned by transform(w), e.g. a
+// gzip.Writer, and closes it at the end. It returns the number of bytes from the buffer that were
+// written to the transforming writer.
+func (b *Buffer) PipeThrough(w io.Writer,
+	transform func(io.Writer) io.WriteCloser) (int64, error) {
+	tw := transform(w)
+	n, err := writeChunks(tw, b.Bytes())
+	if err != nil {
+		tw.Close()
+		return n, err
+	}
+	return n, tw.Close()
+}
+
 // Reset would reset the buffer to be reused.
 func (b *Buffer) Reset() {
 	b.offset = uint64(b.StartOffset())
+	b.readOff = 0
+}
+
+// ResetZero works like Reset, but wipes the bytes written so far first, so they can't be read back
+// through Bytes, or copied around by a later Grow. Use it for buffers holding sensitive data. The
+// cost is linear in the bytes written, unlike Reset. The Go compiler doesn't elide stores to heap
+// memory, so the wipe can't be optimized away.
+func (b *Buffer) ResetZero() {
+	b.mustBeWritable()
+	zero(b.buf[:b.offset])
+	b.Reset()
+}
+
+// ResetKeepHeader works like Reset, but keeps the first headerLen bytes written to the buffer.
+// This is useful for buffers which start with a header that is written only once. It panics if
+// fewer than headerLen bytes have been written so far.
+func (b *Buffer) ResetKeepHeader(headerLen int) {
+	if headerLen < 0 || headerLen > b.LenNoPadding() {
+		panic(bufferPanic{errors.Errorf("header length %d beyond written length %d",
+			headerLen, b.LenNoPadding())})
+	}
+	b.offset = uint64(b.StartOffset() + headerLen)
+	b.clampReadOff()
+}
+
+// Truncate discards all but the first n bytes written to the buffer, padding excluded, e.g. to roll
+// back speculative writes. Unlike Reset, it keeps the bytes before n, and unlike Shrink, it doesn't
+// change the capacity. Call Shrink afterwards to also cut down the file of an UseMmap buffer. It
+// returns an error if n is negative or beyond the bytes written.
+func (b *Buffer) Truncate(n int) error {
+	if n < 0 || n > b.LenNoPadding() {
+		return errors.Errorf("z.Buffer cannot truncate to: %d with length: %d", n, b.LenNoPadding())
+	}
+	b.offset = uint64(b.StartOffset() + n)
+	b.clampReadOff()
+	return nil
+}
+
+// clampReadOff keeps the read cursor within the bytes written, once the offset was moved back.
+func (b *Buffer) clampReadOff() {
+	if n := b.LenNoPadding(); b.readOff > n {
+		b.readOff = n
+	}
+}
+
+// Renew releases the backing memory of the buffer, and replaces it with freshly allocated memory
+// of the capacity the buffer was created with. Unlike Reset, which reuses the memory as is, this
+// leaves the buffer as good as new: zeroed in UseCalloc mode, and backed by a new tempfile in
+// UseMmap mode. A buffer which switched over to mmap via WithAutoMmap or WithSpillAfter goes back
+// to UseCalloc, and its tempfile is deleted. Persistent buffers can't be renewed.
+func (b *Buffer) Renew() error {
+	if b.bufType != UseCalloc && b.bufType != UseMmap {
+		return errors.Errorf("cannot renew a %s buffer", b.bufType)
+	}
+	if b.persistent {
+		return errors.New("cannot renew a persistent buffer")
+	}
+	toCalloc := b.bufType == UseCalloc || b.autoMmapAfter > 0 || b.spilled
+	var dir string
+	if !toCalloc {
+		if b.mmapFile == nil {
+			return errors.New("cannot renew a released buffer")
+		}
+		dir = filepath.Dir(b.mmapFile.Fd.Name())
+	}
+	if b.grown {
+		b.noteGrowShrinkCycle()
+	}
+	if err := b.Release(); err != nil {
+		return err
+	}
+
+	sz := b.initSz
+	if sz < defaultCapacity {
+		sz = defaultCapacity
+	}
+	if toCalloc {
+		b.buf, b.bufType, b.mmapFile = callocBuffer(sz, b.tag), UseCalloc, nil
+		b.spilled = false
+	} else {
+		mmapFile, err := newMmapBacking(dir, sz)
+		if err != nil {
+			b.buf, b.mmapFile = nil, nil
+			return errors.Wrapf(err, "while renewing buffer")
+		}
+		b.buf, b.mmapFile = mmapFile.Data, mmapFile
+	}
+	b.curSz = len(b.buf)
+	b.offset = b.padding
+	b.readOff = 0
+	b.growFactor, b.growBurst, b.lastGrow = 0, 0, time.Time{}
+	b.reallocs, b.copied = 0, 0
+	return nil
+}
+
+// WithThrashWarning makes the buffer log a warning, once, after cycles times that it was grown and
+// then shrunk back by Renew or Shrink. A buffer which keeps going through such cycles, e.g.
+// because a pool hands out buffers with a too small capacity, wastes allocator work, and should
+// rather be created with the capacity it keeps growing to. Stats reports the number of cycles
+// either way.
+func (b *Buffer) WithThrashWarning(cycles int) *Buffer {
+	b.thrashAfter = cycles
+	return b
+}
+
+func (b *Buffer) noteGrowShrinkCycle() {
+	b.grown = false
+	b.cycles++
+	if b.curSz > b.peakSz {
+		b.peakSz = b.curSz
+	}
+	if b.thrashAfter > 0 && b.cycles >= b.thrashAfter && !b.thrashWarn {
+		b.thrashWarn = true
+		glog.Warningf("z.Buffer %q was grown and shrunk %d times. Consider creating it with "+
+			"a capacity of %d instead of %d.", b.tag, b.cycles, b.peakSz, b.initSz)
+	}
 }
 
 // Release would free up the memory allocated by the buffer. Once the usage of buffer is done, it is
-// important to call Release, otherwise a memory leak can happen.
+// important to call Release, otherwise a memory leak can happen. If readers returned by NewReader
+// or iterators from NewSliceIterator weren't closed yet, Release logs an error and returns it,
+// without freeing the memory they read. Calling Release again after a successful Release is a
+// no-op.
 func (b *Buffer) Release() error {
 	if b == nil {
 		return nil
 	}
+	return b.release(-1, !b.persistent)
+}
+
+// ReleaseKeepFile works like Release, but keeps the backing file of an UseMmap buffer on disk, even
+// if it was created via NewBufferTmp. The file is unmapped and closed, but instead of being deleted
+// it's truncated to the bytes written, so that its length equals the offset. This way, reopening it
+// via NewBufferReadOnly restores the slices, and so does NewBufferPersistent after setting the
+// offset to the size of the file. For other buffers, it's the same as Release.
+func (b *Buffer) ReleaseKeepFile() error {
+	if b == nil {
+		return nil
+	}
+	if b.readOnly {
+		// The file was opened O_RDONLY, and already ends at the offset.
+		return b.release(-1, false)
+	}
+	return b.release(int64(b.offset), false)
+}
+
+// release frees the memory of the buffer. For UseMmap, the file is truncated to maxSz if it's not
+// negative, and deleted if remove is set.
+func (b *Buffer) release(maxSz int64, remove bool) error {
+	if n := atomic.LoadInt32(&b.readers); n > 0 {
+		err := errors.Errorf("cannot release z.Buffer %q with %d outstanding readers", b.tag, n)
+		glog.Errorf("%v. Close the readers first. Release called at:\n%s", err, debug.Stack())
+		return err
+	}
+	if b.buf == nil {
+		return nil
+	}
 	switch b.bufType {
 	case UseCalloc:
-		Free(b.buf)
+		freeBuffer(b.buf, b.tag)
 	case UseMmap:
 		if b.mmapFile == nil {
-			return nil
+			break
 		}
 		path := b.mmapFile.Fd.Name()
-		if err := b.mmapFile.Close(-1); err != nil {
+		if err := b.mmapFile.Close(maxSz); err != nil {
 			return errors.Wrapf(err, "while closing file: %s", path)
 		}
-		if !b.persistent {
+		if remove {
 			if err := os.Remove(path); err != nil {
 				return errors.Wrapf(err, "while deleting file %s", path)
 			}
 		}
 	}
+	b.buf, b.mmapFile, b.curSz = nil, nil, 0
 	return nil
 }
+
+// ReleaseSecure works like Release, but zeroes out the memory of the buffer first, so sensitive
+// data doesn't linger in memory that the allocator may hand out again. Note that this touches
+// every byte of the buffer's capacity, which is costly for big buffers. In UseMmap mode, it also
+// makes every page of the file dirty.
+func (b *Buffer) ReleaseSecure() error {
+	if b == nil {
+		return nil
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	if b.bufType == UseCalloc || b.bufType == UseMmap {
+		zero(b.buf[:b.curSz])
+	}
+	return b.Release()
+}
+
+func poison(buf []byte) {
+	for i := range buf {
+		buf[i] = 0xde
+	}
+}
+
+func zero(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
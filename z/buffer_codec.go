@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"compress/flate"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Codec compresses the bytes of a buffer for CompressTo, and decompresses them for DecompressFrom.
+// Both sides are streams, so the compressed bytes never need to be held in memory all at once.
+//
+// Only NewFlateCodec ships with this package, so that it doesn't pull in any compression library.
+// Codecs like snappy or zstd can be plugged in by wrapping their stream writers and readers:
+//
+//	type snappyCodec struct{}
+//
+//	func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+//		return snappy.NewBufferedWriter(w), nil
+//	}
+//
+//	func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+//		return ioutil.NopCloser(snappy.NewReader(r)), nil
+//	}
+type Codec interface {
+	// NewWriter returns a writer compressing the bytes written to it into w. The bytes must all be
+	// flushed to w once the writer is closed.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing the bytes read from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type flateCodec struct {
+	level int
+}
+
+// NewFlateCodec returns a Codec using DEFLATE, from the standard library, at the given level, e.g.
+// flate.BestSpeed or flate.DefaultCompression.
+func NewFlateCodec(level int) Codec {
+	return flateCodec{level: level}
+}
+
+func (c flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, c.level)
+}
+
+func (c flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// CompressTo writes the bytes of the buffer, as returned by Bytes, to w compressed via codec. The
+// bytes are fed to the codec in chunks of 1MB, like in WriteTo, so neither all of a big UseMmap
+// buffer nor the compressed bytes need to be in memory at once. Unlike WriteTo, it leaves the read
+// cursor as it is.
+func (b *Buffer) CompressTo(w io.Writer, codec Codec) error {
+	cw, err := codec.NewWriter(w)
+	if err != nil {
+		return errors.Wrap(err, "while creating compressor")
+	}
+	if _, err := writeChunks(cw, b.Bytes()); err != nil {
+		cw.Close()
+		return errors.Wrap(err, "while compressing buffer")
+	}
+	return errors.Wrap(cw.Close(), "while flushing compressor")
+}
+
+// DecompressFrom appends the bytes written to r via CompressTo, decompressing them via codec. The
+// bytes hold the slices along with their framing, so the buffer must frame its slices like the one
+// they were compressed from, e.g. via WithVarintLen. Like ReadFrom, it reads until the end of the
+// stream, and it returns an error if the buffer has a max size which can't hold all of it.
+func (b *Buffer) DecompressFrom(r io.Reader, codec Codec) error {
+	cr, err := codec.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "while creating decompressor")
+	}
+	defer cr.Close()
+	if _, err := b.ReadFrom(cr); err != nil {
+		return errors.Wrap(err, "while decompressing buffer")
+	}
+	return nil
+}
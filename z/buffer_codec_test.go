@@ -0,0 +1,100 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingCodec passes the bytes through as they are, counting the writes it gets.
+type countingCodec struct {
+	writes int
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (c *countingCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{writerFunc(func(p []byte) (int, error) {
+		c.writes++
+		return w.Write(p)
+	})}, nil
+}
+
+func (c *countingCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestBufferCompress(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			for i := 0; i < 100000; i++ {
+				binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i%100))
+			}
+			var compressed bytes.Buffer
+			require.NoError(t, buf.CompressTo(&compressed, NewFlateCodec(flate.BestSpeed)))
+			require.Less(t, compressed.Len(), buf.LenNoPadding()/10)
+
+			out := NewBuffer(64, "test")
+			defer func() { require.NoError(t, out.Release()) }()
+			require.NoError(t, out.DecompressFrom(&compressed, NewFlateCodec(flate.BestSpeed)))
+			require.Equal(t, buf.Bytes(), out.Bytes())
+			require.Equal(t, 100000, out.NumSlices())
+		})
+	}
+
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.Allocate(5 << 20)
+
+	// The codec gets the bytes in chunks, and the read cursor is left as it is.
+	codec := &countingCodec{}
+	var raw bytes.Buffer
+	require.NoError(t, buf.CompressTo(&raw, codec))
+	require.Equal(t, 5, codec.writes)
+	require.Equal(t, buf.Bytes(), raw.Bytes())
+	require.Equal(t, 0, buf.readOff)
+
+	// Corrupted input is reported.
+	var compressed bytes.Buffer
+	require.NoError(t, buf.CompressTo(&compressed, NewFlateCodec(flate.DefaultCompression)))
+	data := compressed.Bytes()[:compressed.Len()/2]
+	out := NewBuffer(64, "test")
+	defer func() { require.NoError(t, out.Release()) }()
+	deflate := NewFlateCodec(flate.DefaultCompression)
+	require.Error(t, out.DecompressFrom(bytes.NewReader(data), deflate))
+
+	// So is running out of room.
+	small := NewBuffer(64, "test").WithMaxSize(1 << 20)
+	defer func() { require.NoError(t, small.Release()) }()
+	require.Error(t, small.DecompressFrom(&compressed, deflate))
+}
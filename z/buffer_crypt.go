@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The bytes sealed by EncryptTo are laid out as a random nonce, picked per call, followed by a
+// sequence of chunks. Every chunk holds a 4-byte header and up to writeChunkSize bytes of the
+// buffer sealed via AES-GCM, using the nonce with the index of the chunk xor'ed into its last 8
+// bytes. The header holds the size of the sealed bytes, with the top bit set on the last chunk, and
+// is authenticated along with them, so chunks can't be reordered, dropped or truncated unnoticed.
+const lastChunkFlag = 1 << 31
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "while creating cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce sets nonce to the nonce of chunk i, given the nonce picked for the stream.
+func chunkNonce(nonce, base []byte, i uint64) {
+	copy(nonce, base)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^i)
+}
+
+// EncryptTo writes the bytes of the buffer, as returned by Bytes, to w encrypted and authenticated
+// via AES-GCM, so they can be persisted on shared disk. The key must be 16, 24 or 32 bytes long,
+// picking AES-128, AES-192 or AES-256. The bytes are sealed in chunks of 1MB, like the writes of
+// WriteTo, so the encrypted bytes are never held in memory all at once. The buffer itself is left
+// as it is, in plaintext. Use DecryptInto to read the bytes back.
+func (b *Buffer) EncryptTo(w io.Writer, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	base := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, base); err != nil {
+		return errors.Wrap(err, "while generating nonce")
+	}
+	if _, err := w.Write(base); err != nil {
+		return err
+	}
+
+	nonce := make([]byte, len(base))
+	sealed := make([]byte, 4, 4+writeChunkSize+gcm.Overhead())
+	data := b.Bytes()
+	for i := uint64(0); ; i++ {
+		chunk := data
+		if len(chunk) > writeChunkSize {
+			chunk = chunk[:writeChunkSize]
+		}
+		data = data[len(chunk):]
+
+		hdr := uint32(len(chunk) + gcm.Overhead())
+		if len(data) == 0 {
+			hdr |= lastChunkFlag
+		}
+		binary.BigEndian.PutUint32(sealed, hdr)
+		chunkNonce(nonce, base, i)
+		out := gcm.Seal(sealed[:4], nonce, chunk, sealed[:4])
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// DecryptInto appends the bytes written to r via EncryptTo with the same key, after verifying that
+// they weren't tampered with. The bytes hold the slices along with their framing, so the buffer
+// must frame its slices like the one they were encrypted from, e.g. via WithVarintLen. If the key
+// is wrong, or the bytes were corrupted or cut short, it returns an error and the buffer is left as
+// it was.
+func (b *Buffer) DecryptInto(r io.Reader, key []byte) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	base := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(r, base); err != nil {
+		return errors.Wrap(err, "while reading nonce")
+	}
+
+	start := b.offset
+	nonce := make([]byte, len(base))
+	sealed := make([]byte, 4+writeChunkSize+gcm.Overhead())
+	for i := uint64(0); ; i++ {
+		if _, err := io.ReadFull(r, sealed[:4]); err != nil {
+			b.offset = start
+			return errors.Wrapf(err, "while reading header of chunk %d", i)
+		}
+		hdr := binary.BigEndian.Uint32(sealed)
+		sz := int(hdr &^ lastChunkFlag)
+		if sz < gcm.Overhead() || sz > writeChunkSize+gcm.Overhead() {
+			b.offset = start
+			return errors.Errorf("invalid size %d of chunk %d", sz, i)
+		}
+		if _, err := io.ReadFull(r, sealed[4:4+sz]); err != nil {
+			b.offset = start
+			return errors.Wrapf(err, "while reading chunk %d", i)
+		}
+		if err := b.grow(sz - gcm.Overhead()); err != nil {
+			b.offset = start
+			return err
+		}
+		chunkNonce(nonce, base, i)
+		plain, err := gcm.Open(b.buf[b.offset:b.offset], nonce, sealed[4:4+sz], sealed[:4])
+		if err != nil {
+			b.offset = start
+			return errors.Wrapf(err, "while decrypting chunk %d", i)
+		}
+		b.offset += uint64(len(plain))
+		if hdr&lastChunkFlag != 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferEncrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			// Spans a few chunks.
+			for i := 0; i < 300000; i++ {
+				binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+			}
+			var sealed bytes.Buffer
+			require.NoError(t, buf.EncryptTo(&sealed, key))
+			s, _ := buf.Slice(buf.StartOffset() + 12*1000)
+			require.False(t, bytes.Contains(sealed.Bytes(), s))
+
+			// The nonce is picked per call.
+			var again bytes.Buffer
+			require.NoError(t, buf.EncryptTo(&again, key))
+			require.NotEqual(t, sealed.Bytes()[:12], again.Bytes()[:12])
+			require.NotEqual(t, sealed.Bytes(), again.Bytes())
+
+			out := NewBuffer(64, "test")
+			defer func() { require.NoError(t, out.Release()) }()
+			require.NoError(t, out.DecryptInto(&sealed, key))
+			require.Equal(t, buf.Bytes(), out.Bytes())
+			require.Equal(t, 300000, out.NumSlices())
+		})
+	}
+
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.Allocate(3 << 20)
+	var sealed bytes.Buffer
+	require.NoError(t, buf.EncryptTo(&sealed, key))
+	data := sealed.Bytes()
+
+	out := NewBuffer(64, "test")
+	defer func() { require.NoError(t, out.Release()) }()
+	out.WriteSlice([]byte("keep"))
+	want := out.BytesCopy()
+	failed := func(data, key []byte) {
+		require.Error(t, out.DecryptInto(bytes.NewReader(data), key))
+		require.Equal(t, want, out.Bytes())
+	}
+
+	// The wrong key.
+	failed(data, bytes.Repeat([]byte{8}, 32))
+	// A flipped byte, in the last chunk so the first ones are appended before it's noticed.
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-100] ^= 1
+	failed(flipped, key)
+	// A flipped header.
+	flipped = append([]byte{}, data...)
+	flipped[12] ^= 0x80
+	failed(flipped, key)
+	// Cut short, within a chunk or right after one.
+	chunk := 4 + writeChunkSize + 16
+	require.Len(t, data, 12+3*chunk)
+	failed(data[:len(data)-1], key)
+	failed(data[:12+2*chunk], key)
+	// Swapped chunks.
+	swapped := append([]byte{}, data[:12]...)
+	swapped = append(swapped, data[12+chunk:12+2*chunk]...)
+	swapped = append(swapped, data[12:12+chunk]...)
+	swapped = append(swapped, data[12+2*chunk:]...)
+	failed(swapped, key)
+	// Not a valid AES key.
+	failed(data, key[:5])
+
+	require.NoError(t, out.DecryptInto(bytes.NewReader(data), key))
+	require.Equal(t, append(want, buf.Bytes()...), out.Bytes())
+
+	empty := NewBuffer(64, "test")
+	defer func() { require.NoError(t, empty.Release()) }()
+	sealed.Reset()
+	require.NoError(t, empty.EncryptTo(&sealed, key))
+	require.NoError(t, empty.DecryptInto(&sealed, key))
+	require.True(t, empty.IsEmpty())
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// DictBuffer stores a sequence of slices dictionary-encoded: every distinct slice is stored once,
+// and the sequence is kept as 4-byte indices into the distinct slices. This takes a lot less
+// memory than a Buffer for data with few distinct values, e.g. categorical columns. Note that the
+// lookup from slice to index is a Go map holding a copy of every distinct slice.
+type DictBuffer struct {
+	values  *Buffer           // distinct slices, in order of first appearance
+	offsets []int             // offsets of the distinct slices in values, by index
+	index   map[string]uint32 // index of every distinct slice
+	ids     *Buffer           // indices of the slices added, in order
+	adds    int
+	hits    int
+}
+
+// DictBufferStats holds the stats of a DictBuffer.
+type DictBufferStats struct {
+	// Slices is the number of slices added.
+	Slices int
+	// DictSize is the number of distinct slices.
+	DictSize int
+	// DictBytes is the number of bytes used to store the distinct slices.
+	DictBytes int
+	// HitRate is the fraction of the added slices which were already in the dictionary.
+	HitRate float64
+}
+
+// NewDictBuffer returns a DictBuffer whose underlying buffers start with the given capacity.
+func NewDictBuffer(capacity int, tag string) *DictBuffer {
+	return &DictBuffer{
+		values: NewBuffer(capacity, tag),
+		index:  make(map[string]uint32),
+		ids:    NewBuffer(capacity, tag),
+	}
+}
+
+// AddSlice appends slice to the sequence, storing it in the dictionary if it isn't there yet.
+func (d *DictBuffer) AddSlice(slice []byte) {
+	d.adds++
+	id, ok := d.index[string(slice)]
+	if ok {
+		d.hits++
+	} else {
+		id = uint32(len(d.offsets))
+		d.offsets = append(d.offsets, int(d.values.offset))
+		d.values.WriteSlice(slice)
+		d.index[string(slice)] = id
+	}
+	binary.BigEndian.PutUint32(d.ids.Allocate(4), id)
+}
+
+// Len returns the number of slices added.
+func (d *DictBuffer) Len() int {
+	return d.adds
+}
+
+// SliceIterate calls f with every slice added, in order, resolved from the dictionary. The
+// slices alias the dictionary, so several calls to f may get the same memory.
+func (d *DictBuffer) SliceIterate(f func(slice []byte) error) error {
+	ids := d.ids.Bytes()
+	for i := 0; i < len(ids); i += 4 {
+		id := binary.BigEndian.Uint32(ids[i:])
+		if int(id) >= len(d.offsets) {
+			return errors.Errorf("invalid dictionary index: %d", id)
+		}
+		slice, _ := d.values.Slice(d.offsets[id])
+		if err := f(slice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the stats of the dictionary.
+func (d *DictBuffer) Stats() DictBufferStats {
+	stats := DictBufferStats{
+		Slices:    d.adds,
+		DictSize:  len(d.offsets),
+		DictBytes: d.values.LenNoPadding(),
+	}
+	if d.adds > 0 {
+		stats.HitRate = float64(d.hits) / float64(d.adds)
+	}
+	return stats
+}
+
+// Release frees up the memory of the underlying buffers.
+func (d *DictBuffer) Release() error {
+	if d == nil {
+		return nil
+	}
+	if err := d.values.Release(); err != nil {
+		return err
+	}
+	return d.ids.Release()
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDictBuffer(t *testing.T) {
+	d := NewDictBuffer(64, "test")
+	defer func() { require.NoError(t, d.Release()) }()
+
+	var want []string
+	for i := 0; i < 1000; i++ {
+		s := fmt.Sprintf("value-%d", i%10)
+		if i == 500 {
+			s = ""
+		}
+		want = append(want, s)
+		d.AddSlice([]byte(s))
+	}
+	require.Equal(t, 1000, d.Len())
+
+	var got []string
+	require.NoError(t, d.SliceIterate(func(slice []byte) error {
+		got = append(got, string(slice))
+		return nil
+	}))
+	require.Equal(t, want, got)
+
+	stats := d.Stats()
+	require.Equal(t, 1000, stats.Slices)
+	require.Equal(t, 11, stats.DictSize)
+	require.Equal(t, 10*(4+7)+4, stats.DictBytes)
+	require.InDelta(t, 989.0/1000, stats.HitRate, 1e-9)
+}
@@ -0,0 +1,46 @@
+// +build linux
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// limitAddressSpace caps the address space of the process to headroom bytes beyond what it maps
+// now, so that mmaping more than that fails, and returns a func lifting the cap again.
+func limitAddressSpace(t *testing.T, headroom uint64) func() {
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	require.NoError(t, err)
+	pages, err := strconv.ParseUint(strings.Fields(string(statm))[0], 10, 64)
+	require.NoError(t, err)
+
+	var old syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_AS, &old))
+	limit := old
+	limit.Cur = pages*uint64(os.Getpagesize()) + headroom
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_AS, &limit))
+	return func() { require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_AS, &old)) }
+}
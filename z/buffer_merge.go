@@ -0,0 +1,241 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"container/heap"
+	"os"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// mergeCursor points to the current slice of one of the buffers being merged.
+type mergeCursor struct {
+	b    *Buffer
+	cur  []byte
+	next int
+}
+
+// advance moves the cursor to the next non-empty slice, returning false once the buffer is
+// exhausted.
+func (c *mergeCursor) advance() bool {
+	for c.next >= 0 {
+		c.cur, c.next = c.b.Slice(c.next)
+		if len(c.cur) > 0 {
+			return true
+		}
+	}
+	c.cur = nil
+	return false
+}
+
+// mergeHeap is a min-heap of cursors, ordered by their current slices.
+type mergeHeap struct {
+	cursors []*mergeCursor
+	less    LessFunc
+}
+
+func (h *mergeHeap) Len() int { return len(h.cursors) }
+func (h *mergeHeap) Less(i, j int) bool {
+	return h.less(h.cursors[i].cur, h.cursors[j].cur)
+}
+func (h *mergeHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+func (h *mergeHeap) Push(x interface{}) {
+	h.cursors = append(h.cursors, x.(*mergeCursor))
+}
+func (h *mergeHeap) Pop() interface{} {
+	c := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return c
+}
+
+// newMergeHeap returns a heap over the non-empty buffers among bufs, which must be individually
+// sorted according to less.
+func newMergeHeap(less LessFunc, bufs ...*Buffer) *mergeHeap {
+	h := &mergeHeap{less: less}
+	for _, b := range bufs {
+		c := &mergeCursor{b: b, next: b.StartOffset()}
+		if !b.IsEmpty() && c.advance() {
+			h.cursors = append(h.cursors, c)
+		}
+	}
+	heap.Init(h)
+	return h
+}
+
+// advanceTop moves the cursor with the smallest slice on to its next slice, dropping it once its
+// buffer is exhausted.
+func (h *mergeHeap) advanceTop() {
+	if h.cursors[0].advance() {
+		heap.Fix(h, 0)
+	} else {
+		heap.Pop(h)
+	}
+}
+
+// merge calls f over the slices of all the buffers, in sorted order.
+func (h *mergeHeap) merge(f func(slice []byte) error) error {
+	for len(h.cursors) > 0 {
+		if err := f(h.cursors[0].cur); err != nil {
+			return err
+		}
+		h.advanceTop()
+	}
+	return nil
+}
+
+// MergeIterator iterates over the slices of several buffers, each sorted according to the same
+// less, in their merged order, without copying them into a combined buffer:
+//
+//	it := NewMergeIterator(less, a, b, c)
+//	for it.Next() {
+//		use(it.Slice())
+//	}
+//
+// Like a SliceIterator, it skips empty slices, and keeps the buffers from being released. It lets
+// go of them once Next returns false, or once Close is called when stopping early.
+type MergeIterator struct {
+	h       *mergeHeap
+	bufs    []*Buffer
+	slice   []byte
+	started bool
+}
+
+// NewMergeIterator returns an iterator positioned before the first of the merged slices of bufs,
+// which must be individually sorted according to less.
+func NewMergeIterator(less LessFunc, bufs ...*Buffer) *MergeIterator {
+	for _, b := range bufs {
+		atomic.AddInt32(&b.readers, 1)
+	}
+	return &MergeIterator{
+		h:    newMergeHeap(less, bufs...),
+		bufs: append([]*Buffer(nil), bufs...),
+	}
+}
+
+// Next moves to the next slice in the merged order, returning false once there are no more slices.
+func (it *MergeIterator) Next() bool {
+	if it.h == nil {
+		return false
+	}
+	// The current slice is only moved past now, so it stays valid until Next is called.
+	if it.started {
+		it.h.advanceTop()
+	}
+	it.started = true
+	if len(it.h.cursors) == 0 {
+		it.Close()
+		return false
+	}
+	it.slice = it.h.cursors[0].cur
+	return true
+}
+
+// Slice returns the current slice. It is only valid until its buffer is modified.
+func (it *MergeIterator) Slice() []byte {
+	return it.slice
+}
+
+// Close lets go of the buffers. Closing an iterator more than once is a no-op.
+func (it *MergeIterator) Close() error {
+	for _, b := range it.bufs {
+		atomic.AddInt32(&b.readers, -1)
+	}
+	it.h, it.bufs, it.slice = nil, nil, nil
+	return nil
+}
+
+// MergeSortBuffers does a k-way merge of the inputs, each holding slices sorted according to less,
+// into a new sorted buffer allocated via Calloc. Use MergeSortBuffersInto to merge into an UseMmap
+// buffer instead, e.g. when the output doesn't fit in memory.
+func MergeSortBuffers(less LessFunc, inputs ...*Buffer) (*Buffer, error) {
+	var sz int
+	for _, in := range inputs {
+		sz += in.LenNoPadding()
+	}
+	out := NewBuffer(sz, "merge")
+	if err := MergeSortBuffersInto(out, less, inputs...); err != nil {
+		out.Release()
+		return nil, err
+	}
+	return out, nil
+}
+
+// MergeSortBuffersInto works like MergeSortBuffers, but appends the merged slices to out, which
+// could be backed by an mmapped file. The merge walks a min-heap over cursors into the inputs, so
+// it only needs memory for a cursor per input, besides out. Empty slices are dropped. If out runs
+// into its max size, the error is returned, with the slices merged so far left in out.
+func MergeSortBuffersInto(out *Buffer, less LessFunc, inputs ...*Buffer) error {
+	return newMergeHeap(less, inputs...).merge(func(slice []byte) error {
+		dst, err := out.SliceAllocateE(len(slice))
+		if err != nil {
+			return err
+		}
+		copy(dst, slice)
+		return nil
+	})
+}
+
+// MergeRunFiles merges the run files at paths, each holding slices sorted according to less, into
+// a new sorted file at outPath. The runs are files of persistent buffers (see NewBufferPersistent)
+// and are mmapped read-only, so they are streamed rather than loaded into memory. The output file
+// is truncated to the length of its data, so it can be used as a run file as well. On error, the
+// output file is removed rather than left behind with partial data.
+func MergeRunFiles(paths []string, less LessFunc, outPath string) error {
+	var runs []*Buffer
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err != nil {
+			return errors.Wrapf(err, "cannot stat run file: %s", path)
+		} else if fi.Size() == 0 {
+			// Empty files can't be mmapped.
+			continue
+		}
+		mf, err := OpenMmapFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return errors.Wrapf(err, "while opening run file: %s", path)
+		}
+		defer mf.Close(-1)
+		runs = append(runs, &Buffer{
+			buf:     mf.Data,
+			bufType: UseInvalid,
+			curSz:   len(mf.Data),
+			offset:  uint64(len(mf.Data)),
+			padding: 8,
+		})
+	}
+
+	file, err := os.OpenFile(outPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "while creating output file: %s", outPath)
+	}
+	out, err := newBufferFile(file, defaultCapacity)
+	if err != nil {
+		os.Remove(outPath)
+		return err
+	}
+	if err := MergeSortBuffersInto(out, less, runs...); err != nil {
+		out.mmapFile.Close(-1)
+		os.Remove(outPath)
+		return err
+	}
+	if err := out.mmapFile.Close(int64(out.offset)); err != nil {
+		os.Remove(outPath)
+		return err
+	}
+	return nil
+}
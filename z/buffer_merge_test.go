@@ -0,0 +1,178 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func lessUint64(a, b []byte) bool {
+	return binary.BigEndian.Uint64(a) < binary.BigEndian.Uint64(b)
+}
+
+func TestMergeRunFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var exp []uint64
+	var paths []string
+	for i, n := range []int{1000, 1, 0, 5000} {
+		path := filepath.Join(dir, "run"+string(rune('0'+i)))
+		run, err := NewBufferPersistent(path, 1<<10)
+		require.NoError(t, err)
+		for j := 0; j < n; j++ {
+			v := rand.Uint64()
+			binary.BigEndian.PutUint64(run.SliceAllocate(8), v)
+			exp = append(exp, v)
+		}
+		run.SortSlice(lessUint64)
+		require.NoError(t, run.Release())
+		paths = append(paths, path)
+	}
+	// An empty file is a valid, empty run.
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, ioutil.WriteFile(empty, nil, 0666))
+	paths = append(paths, empty)
+
+	out := filepath.Join(dir, "out")
+	require.NoError(t, MergeRunFiles(paths, lessUint64, out))
+
+	fi, err := os.Stat(out)
+	require.NoError(t, err)
+	require.Equal(t, int64(8+12*len(exp)), fi.Size())
+
+	data, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	var got []uint64
+	require.NoError(t, NewBufferSlice(data[8:]).SliceIterate(func(slice []byte) error {
+		got = append(got, binary.BigEndian.Uint64(slice))
+		return nil
+	}))
+	sort.Slice(exp, func(i, j int) bool { return exp[i] < exp[j] })
+	require.Equal(t, exp, got)
+}
+
+func TestMergeRunFilesCleanupOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "run")
+	run, err := NewBufferPersistent(path, 1<<10)
+	require.NoError(t, err)
+	for i := 0; i < 64; i++ {
+		binary.BigEndian.PutUint64(run.SliceAllocate(1<<20), uint64(i))
+	}
+	require.NoError(t, run.Release())
+
+	// The run takes up most of the headroom once mapped, so the output can't grow to hold it.
+	out := filepath.Join(dir, "out")
+	lift := limitAddressSpace(t, 96<<20)
+	err = MergeRunFiles([]string{path}, lessUint64, out)
+	lift()
+	require.Error(t, err)
+	_, err = os.Stat(out)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMergeSortBuffers(t *testing.T) {
+	var exp []uint64
+	var inputs []*Buffer
+	for _, n := range []int{1000, 0, 3000, 1} {
+		in, err := NewBufferTmp("", 64)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, in.Release()) }()
+		for j := 0; j < n; j++ {
+			v := rand.Uint64()
+			binary.BigEndian.PutUint64(in.SliceAllocate(8), v)
+			exp = append(exp, v)
+		}
+		in.SortSlice(lessUint64)
+		inputs = append(inputs, in)
+	}
+	sort.Slice(exp, func(i, j int) bool { return exp[i] < exp[j] })
+	collect := func(b *Buffer) []uint64 {
+		var got []uint64
+		require.NoError(t, b.SliceIterate(func(slice []byte) error {
+			got = append(got, binary.BigEndian.Uint64(slice))
+			return nil
+		}))
+		return got
+	}
+
+	out, err := MergeSortBuffers(lessUint64, inputs...)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, out.Release()) }()
+	require.Equal(t, UseCalloc, out.Type())
+	require.Equal(t, exp, collect(out))
+
+	mmapOut, err := NewBufferTmp("", 64)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, mmapOut.Release()) }()
+	require.NoError(t, MergeSortBuffersInto(mmapOut, lessUint64, inputs...))
+	require.Equal(t, exp, collect(mmapOut))
+
+	small := NewBuffer(64, "test").WithMaxSize(1 << 10)
+	defer func() { require.NoError(t, small.Release()) }()
+	require.Error(t, MergeSortBuffersInto(small, lessUint64, inputs...))
+}
+
+func TestMergeIterator(t *testing.T) {
+	var exp []uint64
+	var bufs []*Buffer
+	// Wildly different lengths, including empty buffers.
+	for _, n := range []int{0, 1, 100000, 3, 0, 1000} {
+		buf := NewBuffer(64, "test")
+		defer func() { require.NoError(t, buf.Release()) }()
+		for j := 0; j < n; j++ {
+			v := rand.Uint64()
+			binary.BigEndian.PutUint64(buf.SliceAllocate(8), v)
+			exp = append(exp, v)
+		}
+		buf.SortSlice(lessUint64)
+		bufs = append(bufs, buf)
+	}
+	sort.Slice(exp, func(i, j int) bool { return exp[i] < exp[j] })
+
+	it := NewMergeIterator(lessUint64, bufs...)
+	var got []uint64
+	for it.Next() {
+		got = append(got, binary.BigEndian.Uint64(it.Slice()))
+	}
+	require.Equal(t, exp, got)
+	require.False(t, it.Next())
+
+	// Stopping early keeps the buffers from being released until Close.
+	it = NewMergeIterator(lessUint64, bufs...)
+	require.True(t, it.Next())
+	require.Equal(t, exp[0], binary.BigEndian.Uint64(it.Slice()))
+	require.True(t, it.Next())
+	require.Equal(t, exp[1], binary.BigEndian.Uint64(it.Slice()))
+	require.Error(t, bufs[2].Release())
+	require.NoError(t, it.Close())
+	require.NoError(t, it.Close())
+
+	require.False(t, NewMergeIterator(lessUint64).Next())
+}
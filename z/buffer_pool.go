@@ -0,0 +1,171 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// BufferPool recycles the memory of UseCalloc buffers, so that short-lived buffers don't need to
+// be allocated and freed via Calloc every time. The memory is kept in buckets by capacity, one for
+// every power of two, and the pool retains at most maxRetained bytes of it, freeing whatever
+// doesn't fit. Unlike a sync.Pool, which the GC may empty at any time, the pool never drops memory
+// without freeing it, as Calloc memory isn't reclaimed by the GC. A nil *BufferPool is valid, and
+// allocates and releases buffers as usual. It's safe for concurrent use.
+type BufferPool struct {
+	mu          sync.Mutex
+	free        [][][]byte // backing slices by bucket, bucket i holding capacities in [2^i, 2^(i+1))
+	retained    int        // bytes held by the backing slices in free
+	maxRetained int
+	tag         string
+
+	gets, hits int64
+}
+
+// NewBufferPool returns a pool retaining at most maxRetained bytes, whose buffers are tagged tag.
+func NewBufferPool(maxRetained int, tag string) *BufferPool {
+	if tag == "" {
+		tag = defaultTag
+	}
+	return &BufferPool{
+		free:        make([][][]byte, bits.UintSize),
+		maxRetained: maxRetained,
+		tag:         tag,
+	}
+}
+
+// Get returns an empty UseCalloc buffer with a capacity of at least sz, rounded up to a power of
+// two, reusing memory put back into the pool if it holds enough. The buffer is as good as one
+// returned by NewBuffer, except its memory isn't zeroed. It must be handed back via Put, or
+// released via Release as usual.
+func (p *BufferPool) Get(sz int) *Buffer {
+	if sz < defaultCapacity {
+		sz = defaultCapacity
+	}
+	if p == nil {
+		return NewBuffer(sz, "")
+	}
+	atomic.AddInt64(&p.gets, 1)
+
+	// Every slice in the bucket of the next power of two fits sz. The bucket after it is tried too,
+	// but no further, so small buffers don't tie up big chunks of memory.
+	p.mu.Lock()
+	var buf []byte
+	first := bits.Len(uint(sz - 1))
+	for i := first; i < len(p.free) && i <= first+1 && buf == nil; i++ {
+		if n := len(p.free[i]); n > 0 {
+			buf = p.free[i][n-1]
+			p.free[i][n-1] = nil
+			p.free[i] = p.free[i][:n-1]
+			p.retained -= len(buf)
+		}
+	}
+	p.mu.Unlock()
+
+	if buf == nil {
+		// Round up, so the memory fits requests of the same bucket once it's put back.
+		return NewBuffer(1<<uint(first), p.tag)
+	}
+	atomic.AddInt64(&p.hits, 1)
+	return &Buffer{
+		buf:     buf,
+		bufType: UseCalloc,
+		curSz:   len(buf),
+		initSz:  len(buf),
+		offset:  8,
+		padding: 8,
+		tag:     p.tag,
+	}
+}
+
+// Put hands b back to the pool, which keeps its memory for reuse by Get, if it fits within the
+// bytes the pool retains. Otherwise, the memory is freed. b must not be used afterwards, like after
+// Release. Buffers not backed by Calloc, e.g. of type UseMmap, are released instead, so their
+// files are deleted and closed. So are buffers with outstanding readers, which makes Release log
+// an error. Wipe the buffer via ResetZero first if it holds sensitive data.
+func (p *BufferPool) Put(b *Buffer) {
+	if b == nil || b.buf == nil {
+		return
+	}
+	if p == nil || b.bufType != UseCalloc || atomic.LoadInt32(&b.readers) > 0 {
+		b.Release()
+		return
+	}
+
+	buf := b.buf
+	p.mu.Lock()
+	keep := p.retained+len(buf) <= p.maxRetained
+	if keep {
+		i := bits.Len(uint(len(buf))) - 1
+		p.free[i] = append(p.free[i], buf)
+		p.retained += len(buf)
+	}
+	p.mu.Unlock()
+
+	if !keep {
+		b.Release()
+		return
+	}
+	if b.tag != p.tag {
+		accountBuffer(b.tag, -int64(len(buf)))
+		accountBuffer(p.tag, int64(len(buf)))
+	}
+	b.buf, b.curSz = nil, 0
+}
+
+// Retained returns the number of bytes of memory held by the pool for reuse.
+func (p *BufferPool) Retained() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.retained
+}
+
+// HitRatio returns the fraction of calls to Get which reused memory from the pool.
+func (p *BufferPool) HitRatio() float64 {
+	if p == nil {
+		return 0
+	}
+	gets := atomic.LoadInt64(&p.gets)
+	if gets == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&p.hits)) / float64(gets)
+}
+
+// Release frees all the memory retained by the pool. Buffers handed out by Get are not affected,
+// and may still be put back afterwards.
+func (p *BufferPool) Release() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	free := p.free
+	p.free = make([][][]byte, bits.UintSize)
+	p.retained = 0
+	p.mu.Unlock()
+
+	for _, bucket := range free {
+		for _, buf := range bucket {
+			freeBuffer(buf, p.tag)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool(1<<20, "pool-test")
+	defer p.Release()
+
+	b := p.Get(1000)
+	require.GreaterOrEqual(t, b.Capacity(), 1000)
+	b.WithVarintLen().WriteSlice([]byte("abc"))
+	mem := &b.buf[0]
+	p.Put(b)
+	require.Nil(t, b.buf)
+	require.Equal(t, 1024, p.Retained())
+
+	// The memory is reused, but the buffer is as good as new.
+	b = p.Get(600)
+	require.Equal(t, mem, &b.buf[0])
+	require.True(t, b.IsEmpty())
+	require.False(t, b.varintLen)
+	require.Equal(t, 0, p.Retained())
+	require.Equal(t, 0.5, p.HitRatio())
+
+	// A buffer which grew is kept by its new capacity, rounded down to a power of two, so it's only
+	// handed out for requests it fits.
+	b.Allocate(5000)
+	capacity := b.Capacity()
+	require.True(t, capacity > 4096 && capacity < 8192)
+	p.Put(b)
+	require.Equal(t, capacity, p.Retained())
+	small := p.Get(64)
+	require.Equal(t, 64, small.Capacity())
+	big := p.Get(capacity)
+	require.Equal(t, 8192, big.Capacity())
+	require.NoError(t, big.Release())
+	big = p.Get(4096)
+	require.Equal(t, capacity, big.Capacity())
+	require.Equal(t, 0, p.Retained())
+
+	// Nothing beyond the max is retained.
+	huge := p.Get(2 << 20)
+	p.Put(huge)
+	require.Nil(t, huge.buf)
+	p.Put(big)
+	p.Put(small)
+	require.Equal(t, capacity+small.initSz, p.Retained())
+	require.Equal(t, int64(p.Retained()), BufferBytesByLabel()["pool-test"])
+
+	// Buffers from elsewhere are moved over to the tag of the pool.
+	other := NewBuffer(64<<10, "pool-test-other")
+	p.Put(other)
+	require.Zero(t, BufferBytesByLabel()["pool-test-other"])
+	require.Equal(t, int64(p.Retained()), BufferBytesByLabel()["pool-test"])
+
+	p.Release()
+	require.Equal(t, 0, p.Retained())
+	require.Zero(t, BufferBytesByLabel()["pool-test"])
+
+	// Mmap buffers are released, so their files don't leak.
+	tmp, err := NewBufferTmp("", 1<<10)
+	require.NoError(t, err)
+	path := tmp.mmapFile.Fd.Name()
+	p.Put(tmp)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, 0, p.Retained())
+
+	// So are buffers which still have readers, which can't be recycled.
+	b = p.Get(64)
+	r := b.NewReader()
+	p.Put(b)
+	require.Equal(t, 0, p.Retained())
+	require.NotNil(t, b.buf)
+	require.NoError(t, r.Close())
+	require.NoError(t, b.Release())
+
+	// A nil pool allocates and releases as usual.
+	var np *BufferPool
+	b = np.Get(64)
+	b.WriteSlice([]byte("abc"))
+	np.Put(b)
+	require.Nil(t, b.buf)
+	np.Release()
+}
+
+func TestBufferPoolConcurrent(t *testing.T) {
+	p := NewBufferPool(16<<20, "pool-test-concurrent")
+	defer p.Release()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				b := p.Get(1 << uint(8+(i+j)%10))
+				b.WriteSlice(make([]byte, 100))
+				p.Put(b)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, p.Retained(), 16<<20)
+	require.Greater(t, p.HitRatio(), 0.9)
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	const sz = 256 << 10
+	b.Run("Pooled", func(b *testing.B) {
+		p := NewBufferPool(64<<20, "bench")
+		defer p.Release()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				buf := p.Get(sz)
+				buf.Allocate(sz / 2)
+				p.Put(buf)
+			}
+		})
+	})
+	b.Run("Fresh", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				buf := NewBuffer(sz, "bench")
+				buf.Allocate(sz / 2)
+				require.NoError(b, buf.Release())
+			}
+		})
+	})
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"container/heap"
+	"math/rand"
+	"sort"
+)
+
+// newLike returns an empty buffer allocated via Calloc, which frames its slices like b, so the raw
+// slices of b can be copied over as they are.
+func (b *Buffer) newLike(capacity int) *Buffer {
+	out := NewBuffer(capacity, b.tag)
+	out.varintLen, out.wideLen, out.fixedWidth = b.varintLen, b.wideLen, b.fixedWidth
+	out.timestamps = b.timestamps
+	return out
+}
+
+// topKHeap is a max-heap of the offsets of slices in b, ordered by less over the slices.
+type topKHeap struct {
+	b       *Buffer
+	offsets []int
+	less    LessFunc
+}
+
+func (h *topKHeap) slice(i int) []byte {
+	return h.b.payload(h.b.rawSlice(h.b.buf[h.offsets[i]:]))
+}
+
+func (h *topKHeap) Len() int           { return len(h.offsets) }
+func (h *topKHeap) Less(i, j int) bool { return h.less(h.slice(j), h.slice(i)) }
+func (h *topKHeap) Swap(i, j int)      { h.offsets[i], h.offsets[j] = h.offsets[j], h.offsets[i] }
+func (h *topKHeap) Push(x interface{}) { h.offsets = append(h.offsets, x.(int)) }
+func (h *topKHeap) Pop() interface{} {
+	off := h.offsets[len(h.offsets)-1]
+	h.offsets = h.offsets[:len(h.offsets)-1]
+	return off
+}
+
+// TopK returns a new buffer holding the k smallest slices of b according to less, in sorted order.
+// Instead of sorting all of b, it does a single pass keeping the k smallest slices seen so far in
+// a max-heap, which is O(n log k). Empty slices are included, like in ForEach. If b has fewer than
+// k slices, all of them are returned. The new buffer is allocated via Calloc, and needs to be
+// released by the caller.
+func (b *Buffer) TopK(k int, less LessFunc) *Buffer {
+	h := &topKHeap{b: b, less: less}
+	for next := b.StartOffset(); next < int(b.offset) && k > 0; {
+		raw := b.rawSlice(b.buf[next:])
+		switch {
+		case len(h.offsets) < k:
+			heap.Push(h, next)
+		case less(b.payload(raw), h.slice(0)):
+			// Smaller than the largest of the k slices kept, so replace it.
+			h.offsets[0] = next
+			heap.Fix(h, 0)
+		}
+		next += len(raw)
+	}
+
+	// Popping the max-heap gives the slices from the largest down.
+	sorted := make([]int, len(h.offsets))
+	var sz int
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(h).(int)
+		sz += len(b.rawSlice(b.buf[sorted[i]:]))
+	}
+	out := b.newLike(sz)
+	for _, off := range sorted {
+		check2(out.Write(b.rawSlice(b.buf[off:])))
+	}
+	return out
+}
+
+// Sample returns a new buffer holding a uniform random sample of n slices of b, picked via
+// reservoir sampling in a single pass over b. The slices are kept in the order they're in b, and
+// empty slices are included, like in ForEach. If b has n slices or less, all of them are returned.
+// The sample only depends on the numbers drawn from rng, so it's deterministic for a given seed.
+// The new buffer is allocated via Calloc, and needs to be released by the caller.
+func (b *Buffer) Sample(n int, rng *rand.Rand) *Buffer {
+	var reservoir []int
+	seen := 0
+	for next := b.StartOffset(); next < int(b.offset) && n > 0; seen++ {
+		if len(reservoir) < n {
+			reservoir = append(reservoir, next)
+		} else if i := rng.Int63n(int64(seen + 1)); i < int64(n) {
+			reservoir[i] = next
+		}
+		next += len(b.rawSlice(b.buf[next:]))
+	}
+
+	sort.Ints(reservoir)
+	var sz int
+	for _, off := range reservoir {
+		sz += len(b.rawSlice(b.buf[off:]))
+	}
+	out := b.newLike(sz)
+	for _, off := range reservoir {
+		check2(out.Write(b.rawSlice(b.buf[off:])))
+	}
+	return out
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func uint64s(t testing.TB, b *Buffer) []uint64 {
+	var got []uint64
+	require.NoError(t, b.SliceIterate(func(slice []byte) error {
+		got = append(got, binary.BigEndian.Uint64(slice))
+		return nil
+	}))
+	return got
+}
+
+func TestBufferTopK(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			var all []uint64
+			for i := 0; i < 10000; i++ {
+				v := uint64(rand.Intn(5000))
+				binary.BigEndian.PutUint64(buf.SliceAllocate(8), v)
+				all = append(all, v)
+			}
+			sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+
+			for _, k := range []int{0, 1, 10, 1000, 10000, 20000} {
+				top := buf.TopK(k, lessUint64)
+				want := all
+				if k < len(all) {
+					want = all[:k]
+				}
+				got := uint64s(t, top)
+				if k == 0 {
+					require.Empty(t, got)
+				} else {
+					require.Equal(t, want, got, "k: %d", k)
+				}
+				require.NoError(t, top.Release())
+			}
+			// The buffer itself is left as it was.
+			require.Equal(t, 10000, buf.NumSlices())
+		})
+	}
+
+	buf := NewBuffer(64, "test").WithVarintLen()
+	defer func() { require.NoError(t, buf.Release()) }()
+	for _, s := range []string{"d", "", "b", "c", "a"} {
+		buf.WriteSlice([]byte(s))
+	}
+	top := buf.TopK(3, func(a, b []byte) bool { return string(a) < string(b) })
+	defer func() { require.NoError(t, top.Release()) }()
+	var got []string
+	require.NoError(t, top.ForEach(func(slice []byte) error {
+		got = append(got, string(slice))
+		return nil
+	}))
+	require.Equal(t, []string{"", "a", "b"}, got)
+}
+
+func TestBufferSample(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			const total = 1000
+			for i := 0; i < total; i++ {
+				binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+			}
+
+			sample := buf.Sample(100, rand.New(rand.NewSource(1)))
+			got := uint64s(t, sample)
+			require.NoError(t, sample.Release())
+			require.Len(t, got, 100)
+			require.True(t, sort.SliceIsSorted(got, func(i, j int) bool { return got[i] < got[j] }))
+			for i := 1; i < len(got); i++ {
+				require.NotEqual(t, got[i-1], got[i])
+			}
+
+			// The same seed gives the same sample.
+			again := buf.Sample(100, rand.New(rand.NewSource(1)))
+			require.Equal(t, got, uint64s(t, again))
+			require.NoError(t, again.Release())
+
+			all := buf.Sample(total+1, rand.New(rand.NewSource(1)))
+			require.Len(t, uint64s(t, all), total)
+			require.Equal(t, buf.Bytes(), all.Bytes())
+			require.NoError(t, all.Release())
+
+			none := buf.Sample(0, rand.New(rand.NewSource(1)))
+			require.True(t, none.IsEmpty())
+			require.NoError(t, none.Release())
+		})
+	}
+
+	// Every slice is about equally likely to be picked.
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	for i := 0; i < 10; i++ {
+		binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+	}
+	counts := make([]int, 10)
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 10000; i++ {
+		sample := buf.Sample(3, rng)
+		for _, v := range uint64s(t, sample) {
+			counts[v]++
+		}
+		require.NoError(t, sample.Release())
+	}
+	for _, c := range counts {
+		require.InDelta(t, 3000, c, 300)
+	}
+}
+
+func BenchmarkBufferTopK(b *testing.B) {
+	const n, k = 5 << 20, 100
+	buf := NewBuffer(n*12, "test")
+	defer func() { require.NoError(b, buf.Release()) }()
+	values := make([]uint64, n)
+	for i := range values {
+		values[i] = rand.Uint64()
+	}
+	fill := func() {
+		buf.Reset()
+		for _, v := range values {
+			binary.BigEndian.PutUint64(buf.SliceAllocate(8), v)
+		}
+	}
+	fill()
+	b.Run("TopK", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, buf.TopK(k, lessUint64).Release())
+		}
+	})
+	b.Run("SortSlice", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			fill()
+			b.StartTimer()
+			buf.SortSlice(lessUint64)
+			require.NoError(b, buf.Truncate(k*12))
+		}
+	})
+}
@@ -18,14 +18,28 @@ package z
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -247,6 +261,310 @@ func TestBufferSort(t *testing.T) {
 	}
 }
 
+func TestBufferSortParallel(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	// Use an odd number of blocks, so the merge tree isn't balanced.
+	const N = 13*1024 + 100
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			var want []uint64
+			for i := 0; i < N; i++ {
+				uid := rand.Uint64()
+				want = append(want, uid)
+				binary.BigEndian.PutUint64(buf.SliceAllocate(8), uid)
+			}
+			sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+
+			buf.SortSliceParallel(func(ls, rs []byte) bool {
+				return binary.BigEndian.Uint64(ls) < binary.BigEndian.Uint64(rs)
+			}, 0)
+			var got []uint64
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				got = append(got, binary.BigEndian.Uint64(slice))
+				return nil
+			}))
+			require.Equal(t, want, got)
+		})
+	}
+
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	for i := 0; i < N; i++ {
+		binary.BigEndian.PutUint64(buf.SliceAllocate(8), rand.Uint64())
+	}
+
+	// A panic in less reaches the caller.
+	var calls int64
+	require.PanicsWithValue(t, "less", func() {
+		buf.SortSliceParallel(func(ls, rs []byte) bool {
+			if atomic.AddInt64(&calls, 1) == 1000 {
+				panic("less")
+			}
+			return binary.BigEndian.Uint64(ls) < binary.BigEndian.Uint64(rs)
+		}, 4)
+	})
+	require.Equal(t, N, buf.NumSlices())
+
+	// The other sorts call less from the calling goroutine only, so it needn't be safe for
+	// concurrent calls. Running with -race catches it otherwise.
+	var count int
+	counting := func(ls, rs []byte) bool {
+		count++
+		return binary.BigEndian.Uint64(ls) < binary.BigEndian.Uint64(rs)
+	}
+	buf.SortSlice(counting)
+	require.True(t, buf.IsSorted(lessUint64))
+	buf.SortSliceDesc(counting)
+	buf.SortSliceStable(counting)
+	require.NoError(t, buf.SortSliceContext(context.Background(), counting))
+	require.True(t, buf.IsSorted(lessUint64))
+	require.Greater(t, count, N)
+}
+
+func TestBufferSortSliceContext(t *testing.T) {
+	const N = 20 * 1024
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			var want []uint64
+			for i := 0; i < N; i++ {
+				uid := rand.Uint64()
+				want = append(want, uid)
+				binary.BigEndian.PutUint64(buf.SliceAllocate(8), uid)
+			}
+			sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+
+			// Cancel the sort after a while, from within the comparisons.
+			ctx, cancel := context.WithCancel(context.Background())
+			var calls int64
+			less := func(ls, rs []byte) bool {
+				if atomic.AddInt64(&calls, 1) == N {
+					cancel()
+				}
+				return binary.BigEndian.Uint64(ls) < binary.BigEndian.Uint64(rs)
+			}
+			require.Equal(t, context.Canceled, buf.SortSliceContext(ctx, less))
+			require.False(t, buf.IsSorted(less))
+
+			// All the slices must still be intact.
+			var got []uint64
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				require.Len(t, slice, 8)
+				got = append(got, binary.BigEndian.Uint64(slice))
+				return nil
+			}))
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			require.Equal(t, want, got)
+
+			require.NoError(t, buf.SortSliceContext(context.Background(), less))
+			require.True(t, buf.IsSorted(less))
+		})
+	}
+}
+
+func TestBufferSortSliceDesc(t *testing.T) {
+	less := func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+	for _, varint := range []bool{false, true} {
+		t.Run(fmt.Sprintf("varint=%v", varint), func(t *testing.T) {
+			buf := NewBuffer(64, "test")
+			defer func() { require.NoError(t, buf.Release()) }()
+			if varint {
+				buf.WithVarintLen()
+			}
+			// Varying sizes make the length prefixes differ, so comparing them would show.
+			for i := 0; i < 5000; i++ {
+				slice := make([]byte, 1+rand.Intn(300))
+				rand.Read(slice)
+				buf.WriteSlice(slice)
+			}
+			buf.SortSliceDesc(less)
+			require.True(t, buf.IsSorted(func(a, b []byte) bool { return less(b, a) }))
+			require.Equal(t, 5000, buf.NumSlices())
+		})
+	}
+}
+
+func TestBufferSortSliceStable(t *testing.T) {
+	for _, procs := range []int{1, 4} {
+		t.Run(fmt.Sprintf("procs=%d", procs), func(t *testing.T) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			buf := NewBuffer(64, "test")
+			defer func() { require.NoError(t, buf.Release()) }()
+
+			// Few distinct keys, followed by the insertion order to break ties with.
+			const N = 10*1024 + 7
+			for i := 0; i < N; i++ {
+				slice := buf.SliceAllocate(12)
+				binary.BigEndian.PutUint32(slice, uint32(rand.Intn(16)))
+				binary.BigEndian.PutUint64(slice[4:], uint64(i))
+			}
+			buf.SortSliceStable(func(ls, rs []byte) bool {
+				return binary.BigEndian.Uint32(ls) < binary.BigEndian.Uint32(rs)
+			})
+
+			var lastKey uint32
+			var lastIdx uint64
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				key, idx := binary.BigEndian.Uint32(slice), binary.BigEndian.Uint64(slice[4:])
+				require.GreaterOrEqual(t, key, lastKey)
+				if key == lastKey {
+					require.GreaterOrEqual(t, idx, lastIdx)
+				}
+				lastKey, lastIdx = key, idx
+				return nil
+			}))
+			require.Equal(t, N, buf.NumSlices())
+		})
+	}
+}
+
+// rss returns the resident set size of the process, as read from /proc/self/statm.
+func rss(b *testing.B) int {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		b.Skipf("Unable to read RSS: %v", err)
+	}
+	fields := strings.Fields(string(data))
+	pages, err := strconv.Atoi(fields[1])
+	require.NoError(b, err)
+	return pages * os.Getpagesize()
+}
+
+func BenchmarkBufferShrink(b *testing.B) {
+	const spike = 256 << 20
+	var before, after int
+	for i := 0; i < b.N; i++ {
+		buf := NewBuffer(1<<10, "test")
+		for buf.LenNoPadding() < spike {
+			page := buf.Allocate(1 << 20)
+			for j := 0; j < len(page); j += os.Getpagesize() {
+				page[j] = 1
+			}
+		}
+		buf.Reset()
+		buf.SliceAllocate(8)
+
+		debug.FreeOSMemory()
+		before += rss(b)
+		require.NoError(b, buf.Shrink())
+		debug.FreeOSMemory()
+		after += rss(b)
+		require.NoError(b, buf.Release())
+	}
+	b.ReportMetric(float64(before/b.N)/(1<<20), "MiB-rss-before")
+	b.ReportMetric(float64(after/b.N)/(1<<20), "MiB-rss-after")
+}
+
+func BenchmarkBufferReset(b *testing.B) {
+	for _, sz := range []int{1 << 10, 1 << 20, 64 << 20} {
+		buf := NewBuffer(sz, "test")
+		b.Run(fmt.Sprintf("Reset/%d", sz), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				buf.Allocate(sz)
+				buf.Reset()
+			}
+		})
+		b.Run(fmt.Sprintf("ResetZero/%d", sz), func(b *testing.B) {
+			b.SetBytes(int64(sz))
+			for i := 0; i < b.N; i++ {
+				buf.Allocate(sz)
+				buf.ResetZero()
+			}
+		})
+		require.NoError(b, buf.Release())
+	}
+}
+
+func BenchmarkBufferSortFixedWidth(b *testing.B) {
+	less := func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+	records := make([]byte, 1<<20*32)
+	rand.Read(records)
+	for _, fixed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fixed=%v", fixed), func(b *testing.B) {
+			buf := NewBuffer(len(records)*2, "test")
+			defer func() { require.NoError(b, buf.Release()) }()
+			if fixed {
+				buf.WithFixedWidth(32)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				buf.Reset()
+				for off := 0; off < len(records); off += 32 {
+					buf.WriteSlice(records[off : off+32])
+				}
+				b.StartTimer()
+				buf.SortSlice(less)
+			}
+			b.ReportMetric(float64(buf.LenNoPadding()), "bytes")
+		})
+	}
+}
+
+func BenchmarkBufferSortSliceRadix(b *testing.B) {
+	const n = 10 << 20
+	records := make([]byte, n*16)
+	rand.Read(records)
+	buf := NewBuffer(n*20, "test")
+	defer func() { require.NoError(b, buf.Release()) }()
+	fill := func() {
+		buf.Reset()
+		for off := 0; off < len(records); off += 16 {
+			buf.WriteSlice(records[off : off+16])
+		}
+	}
+	b.Run("SortSlice", func(b *testing.B) {
+		less := func(a, b []byte) bool {
+			return binary.BigEndian.Uint64(a) < binary.BigEndian.Uint64(b)
+		}
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			fill()
+			b.StartTimer()
+			buf.SortSlice(less)
+		}
+	})
+	b.Run("SortSliceRadix", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			fill()
+			b.StartTimer()
+			buf.SortSliceRadix(8)
+		}
+	})
+}
+
+func BenchmarkBufferSortSlice(b *testing.B) {
+	const N = 10 << 20
+	src := NewBuffer(N*12, "test")
+	defer src.Release()
+	for i := 0; i < N; i++ {
+		binary.BigEndian.PutUint64(src.SliceAllocate(8), rand.Uint64())
+	}
+	less := func(ls, rs []byte) bool {
+		return binary.BigEndian.Uint64(ls) < binary.BigEndian.Uint64(rs)
+	}
+
+	allProcs := []int{1}
+	if n := runtime.NumCPU(); n > 1 {
+		allProcs = append(allProcs, n)
+	}
+	for _, procs := range allProcs {
+		b.Run(fmt.Sprintf("procs=%d", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				buf, err := src.Clone()
+				require.NoError(b, err)
+				b.StartTimer()
+				buf.SortSliceParallel(less, procs)
+				b.StopTimer()
+				require.NoError(b, buf.Release())
+			}
+		})
+	}
+}
+
 // Test that the APIs returns the expected offsets.
 func TestBufferPadding(t *testing.T) {
 	bufs := newTestBuffers(t, 1<<10)
@@ -301,3 +619,2255 @@ func TestSmallBuffer(t *testing.T) {
 		})
 	})
 }
+
+func TestBufferCapacity(t *testing.T) {
+	buf := NewBuffer(1<<10, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	require.Equal(t, 1<<10, buf.Capacity())
+	require.Zero(t, buf.MaxSize())
+
+	buf.WithMaxSize(1 << 20)
+	require.Equal(t, 1<<20, buf.MaxSize())
+	buf.Allocate(1 << 10)
+	require.Greater(t, buf.Capacity(), 1<<10)
+	require.Equal(t, len(buf.buf), buf.Capacity())
+}
+
+func TestBufferSetMaxSize(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.WithMaxSize(1 << 10)
+			buf.Allocate(1000)
+			require.Error(t, buf.TryGrow(1<<10))
+
+			require.NoError(t, buf.SetMaxSize(1<<12))
+			require.NoError(t, buf.TryGrow(1<<10))
+			buf.Allocate(1 << 10)
+
+			require.Error(t, buf.SetMaxSize(1<<10))
+			require.Error(t, buf.SetMaxSize(-1))
+			require.Equal(t, 1<<12, buf.MaxSize())
+			require.NoError(t, buf.SetMaxSize(0))
+			buf.Allocate(1 << 14)
+		})
+	}
+
+	// Raising the max size beyond a reserved mapping makes Grow remap the file.
+	buf, err := NewBufferTmp("", 64)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.WithMaxSize(1 << 16)
+	require.NoError(t, buf.ReserveMapping())
+	require.NoError(t, buf.SetMaxSize(1<<20))
+	buf.Allocate(1 << 18)
+	require.GreaterOrEqual(t, len(buf.mmapFile.Data), 1<<18)
+}
+
+func TestBufferMmapMappingFollowsSize(t *testing.T) {
+	buf, err := NewBufferTmp("", 64)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.WithMaxSize(1 << 30)
+
+	// Without ReserveMapping, only the size of the file is mapped, even with a big max size.
+	require.Equal(t, buf.curSz, len(buf.mmapFile.Data))
+	for i := 0; i < 10; i++ {
+		buf.Allocate(1 << 16)
+		require.Equal(t, buf.curSz, len(buf.mmapFile.Data))
+	}
+	fi, err := buf.mmapFile.Fd.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.curSz), fi.Size())
+}
+
+func TestBufferString(t *testing.T) {
+	buf := NewBuffer(64, "test").WithMaxSize(1 << 20)
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.Write([]byte("hi\x00"))
+	require.Equal(t, "Buffer{type:UseCalloc tag:test len:3 cap:64 max:1048576 "+
+		`preview:[68 69 00] "hi."}`, buf.String())
+
+	// The preview is bounded.
+	buf.Write(make([]byte, 1<<16))
+	require.Less(t, len(fmt.Sprintf("%v", buf)), 256)
+
+	var nilBuf *Buffer
+	require.Equal(t, "Buffer(nil)", nilBuf.String())
+}
+
+func TestBufferType(t *testing.T) {
+	buf := NewBuffer(64, "test").WithAutoMmap(1<<10, "")
+	defer func() { require.NoError(t, buf.Release()) }()
+	require.Equal(t, UseCalloc, buf.Type())
+	buf.Allocate(1 << 12)
+	require.Equal(t, UseMmap, buf.Type())
+	require.Equal(t, "UseMmap", buf.Type().String())
+	require.Equal(t, UseInvalid, NewBufferSlice(nil).Type())
+}
+
+func TestBufferConvertTo(t *testing.T) {
+	buf := NewBuffer(1<<10, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	data := make([]byte, 10<<20)
+	rand.Read(data)
+	buf.Write(data)
+
+	var calls, last int
+	err := buf.ConvertToCtx(context.Background(), UseMmap, func(done, total int) {
+		require.Equal(t, buf.LenWithPadding(), total)
+		require.Greater(t, done, last)
+		last = done
+		calls++
+	})
+	require.NoError(t, err)
+	require.Equal(t, UseMmap, buf.bufType)
+	require.Equal(t, buf.LenWithPadding(), last)
+	require.Equal(t, 3, calls)
+	require.Equal(t, data, buf.Bytes())
+
+	require.NoError(t, buf.ConvertTo(UseCalloc))
+	require.Equal(t, UseCalloc, buf.bufType)
+	require.Equal(t, data, buf.Bytes())
+
+	// A cancelled conversion must leave the buffer as it was.
+	ctx, cancel := context.WithCancel(context.Background())
+	err = buf.ConvertToCtx(ctx, UseMmap, func(done, total int) { cancel() })
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, UseCalloc, buf.bufType)
+	require.Equal(t, data, buf.Bytes())
+}
+
+func TestBufferDeduplicate(t *testing.T) {
+	bufs := newTestBuffers(t, 1<<10)
+	for _, buf := range bufs {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			var exp []uint64
+			for i := 0; i < 1000; i++ {
+				exp = append(exp, uint64(i))
+				for j := 0; j < i%4; j++ {
+					binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+				}
+				binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+			}
+			buf.Deduplicate(func(a, b []byte) bool {
+				return bytes.Equal(a, b)
+			})
+
+			var got []uint64
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				got = append(got, binary.BigEndian.Uint64(slice))
+				return nil
+			}))
+			require.Equal(t, exp, got)
+			require.Equal(t, 1000*12, buf.LenNoPadding())
+		})
+	}
+}
+
+func TestBufferGrowReport(t *testing.T) {
+	buf := NewBuffer(64, "test").WithMinGrowth(0)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	oldCap, newCap, realloc := buf.GrowReport(10)
+	require.Equal(t, 64, oldCap)
+	require.Equal(t, 64, newCap)
+	require.False(t, realloc)
+
+	require.False(t, buf.WillGrow(10))
+	require.True(t, buf.WillGrow(100))
+	oldCap, newCap, realloc = buf.GrowReport(100)
+	require.Equal(t, 64, oldCap)
+	require.Equal(t, 64+64+100, newCap)
+	require.True(t, realloc)
+
+	var reallocs int
+	for i := 0; i < 100; i++ {
+		if _, _, realloc := buf.GrowReport(8); realloc {
+			reallocs++
+		}
+		buf.Allocate(8)
+	}
+	require.Equal(t, 2, reallocs)
+	// The first reallocation had to copy over the padding only.
+	require.Equal(t, int64(8+224+464), buf.Stats().BytesCopied)
+}
+
+func TestBufferSliceLenOverflow(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("slices can't be larger than 4GB on 32-bit platforms")
+	}
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	// The overflow must be caught before trying to allocate the memory.
+	shift := uint(32)
+	_, err := buf.SliceAllocateE(1 << shift)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "overflows")
+	require.Panics(t, func() { buf.SliceAllocate(1<<shift + 5) })
+	require.True(t, buf.IsEmpty())
+}
+
+func TestBufferVarintLen(t *testing.T) {
+	buf := NewBuffer(64, "test").WithVarintLen()
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	prefix := make([]byte, binary.MaxVarintLen64)
+	for _, tc := range []struct {
+		sz int64
+		n  int
+	}{
+		{0, 1}, {127, 1}, {128, 2}, {1<<14 - 1, 2}, {1 << 14, 3},
+		{1<<28 - 1, 4}, {1 << 28, 5}, {1<<35 - 1, 5}, {1 << 35, 6},
+	} {
+		if tc.sz > math.MaxInt32 && strconv.IntSize < 64 {
+			continue
+		}
+		require.Equal(t, tc.n, buf.lenSize(int(tc.sz)), "size: %d", tc.sz)
+		require.Equal(t, tc.n, buf.putLen(prefix, int(tc.sz)), "size: %d", tc.sz)
+		sz, n := buf.readLen(prefix)
+		require.Equal(t, int(tc.sz), sz)
+		require.Equal(t, tc.n, n)
+	}
+
+	var sizes []int
+	want := 0
+	for i := 0; i < 1000; i++ {
+		sz := 2 + rand.Intn(300)
+		sizes = append(sizes, sz)
+		want += buf.lenSize(sz) + sz
+		binary.BigEndian.PutUint16(buf.SliceAllocate(sz), uint16(rand.Intn(1<<16)))
+	}
+	require.Equal(t, want, buf.LenNoPadding())
+	var i int
+	require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+		require.Len(t, slice, sizes[i])
+		i++
+		return nil
+	}))
+	require.Equal(t, len(sizes), i)
+
+	less := func(a, b []byte) bool { return bytes.Compare(a[:2], b[:2]) < 0 }
+	buf.SortSlice(less)
+	require.True(t, buf.IsSorted(less))
+	require.Equal(t, len(sizes), len(buf.SliceOffsets()))
+
+	other := NewBuffer(64, "test").WithVarintLen()
+	defer func() { require.NoError(t, other.Release()) }()
+	n, err := other.ReadFramedFrom(iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+	require.NoError(t, err)
+	require.Equal(t, len(sizes), n)
+	require.Equal(t, buf.Bytes(), other.Bytes())
+
+	require.Panics(t, func() { buf.WithVarintLen() })
+}
+
+func TestBufferWideLen(t *testing.T) {
+	buf := NewBuffer(64, "test").WithWideLen()
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	var sizes []int
+	for i := 0; i < 1000; i++ {
+		sz := 2 + rand.Intn(300)
+		sizes = append(sizes, sz)
+		binary.BigEndian.PutUint16(buf.SliceAllocate(sz), uint16(rand.Intn(1<<16)))
+	}
+	require.Equal(t, uint64(sizes[0]), binary.BigEndian.Uint64(buf.Bytes()))
+	less := func(a, b []byte) bool { return bytes.Compare(a[:2], b[:2]) < 0 }
+	buf.SortSlice(less)
+	require.True(t, buf.IsSorted(less))
+	require.Equal(t, len(sizes), buf.NumSlices())
+
+	// The fixed width prefix allows filling in the length afterwards.
+	slice, setLen := buf.SliceAllocateCap(16)
+	copy(slice, "abc")
+	off := setLen(3)
+	enc := buf.RecordEncoder(8)
+	enc.Uint64(42)
+	recOff := enc.Finish()
+	got, _ := buf.Slice(off)
+	require.Equal(t, []byte("abc"), got)
+	got, _ = buf.Slice(recOff)
+	require.Equal(t, uint64(42), binary.BigEndian.Uint64(got))
+
+	other := NewBuffer(64, "test").WithWideLen()
+	defer func() { require.NoError(t, other.Release()) }()
+	n, err := other.ReadFramedFrom(iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+	require.NoError(t, err)
+	require.Equal(t, len(sizes)+2, n)
+	require.Equal(t, buf.Bytes(), other.Bytes())
+
+	narrow := NewBuffer(64, "test")
+	defer func() { require.NoError(t, narrow.Release()) }()
+	require.Error(t, narrow.Merge(buf))
+	require.Panics(t, func() { buf.WithWideLen() })
+	require.Panics(t, func() { NewBuffer(64, "test").WithWideLen().WithVarintLen() })
+}
+
+func TestBufferWideLenOver4GB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the 4GB slice in short mode")
+	}
+	if strconv.IntSize < 64 {
+		t.Skip("slices can't be larger than 4GB on 32-bit platforms")
+	}
+	// The file is sparse, so only the pages written to take up memory and disk.
+	buf, err := NewBufferTmp("", 64)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.WithWideLen()
+
+	// Not a constant, so this compiles on 32-bit platforms too.
+	huge := int64(1<<32 + 10)
+	sz := int(huge)
+	slice := buf.SliceAllocate(sz)
+	slice[0], slice[sz-1] = 'a', 'z'
+	buf.WriteSlice([]byte("next"))
+
+	got, next := buf.Slice(buf.StartOffset())
+	require.Len(t, got, sz)
+	require.Equal(t, byte('z'), got[sz-1])
+	got, _ = buf.Slice(next)
+	require.Equal(t, []byte("next"), got)
+	require.Equal(t, 2, buf.NumSlices())
+}
+
+func TestBufferFixedWidth(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.WithFixedWidth(32)
+			const n = 5000
+			for i := 0; i < n; i++ {
+				rand.Read(buf.SliceAllocate(32))
+			}
+			// No space is taken by length prefixes.
+			require.Equal(t, n*32, buf.LenNoPadding())
+			require.Equal(t, n, buf.NumSlices())
+			require.Equal(t, buf.Bytes()[32:64], buf.RecordAt(1))
+
+			_, err := buf.SliceAllocateE(31)
+			require.Error(t, err)
+			require.Panics(t, func() { buf.RecordAt(n) })
+			require.Panics(t, func() { buf.WithFixedWidth(16) })
+
+			less := func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+			buf.SortSlice(less)
+			require.True(t, buf.IsSorted(less))
+			var count int
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				require.Equal(t, buf.RecordAt(count), slice)
+				count++
+				return nil
+			}))
+			require.Equal(t, n, count)
+
+			other := NewBuffer(64, "test").WithFixedWidth(32)
+			defer func() { require.NoError(t, other.Release()) }()
+			read, err := other.ReadFramedFrom(iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+			require.NoError(t, err)
+			require.Equal(t, n, read)
+			require.Equal(t, buf.Bytes(), other.Bytes())
+			_, err = other.ReadFramedFrom(bytes.NewReader(make([]byte, 40)))
+			require.Equal(t, io.ErrUnexpectedEOF, err)
+			require.Equal(t, n+1, other.NumSlices())
+		})
+	}
+	require.Panics(t, func() { NewBuffer(64, "test").WithFixedWidth(0) })
+	require.Panics(t, func() { NewBuffer(64, "test").WithTimestamps().WithFixedWidth(8) })
+}
+
+func TestBufferMaxSliceSize(t *testing.T) {
+	buf := NewBuffer(1<<10, "test").WithMaxSliceSize(16)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	slice, err := buf.SliceAllocateE(16)
+	require.NoError(t, err)
+	require.Len(t, slice, 16)
+
+	_, err = buf.SliceAllocateE(17)
+	require.Error(t, err)
+	require.Panics(t, func() { buf.SliceAllocate(17) })
+	require.Equal(t, 4+16, buf.LenNoPadding())
+}
+
+func TestBufferDeduplicateShrink(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			// Runs of 100 duplicates each.
+			for i := 0; i < 100; i++ {
+				for j := 0; j < 100; j++ {
+					binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+				}
+			}
+			require.Equal(t, 100*100, buf.NumSlices())
+			buf.Deduplicate(bytes.Equal)
+			require.Equal(t, 100, buf.NumSlices())
+
+			require.NoError(t, buf.Shrink())
+			if buf.bufType == UseMmap {
+				fi, err := buf.mmapFile.Fd.Stat()
+				require.NoError(t, err)
+				require.Equal(t, int64(pageSize), fi.Size())
+			}
+			require.Equal(t, 100, buf.NumSlices())
+		})
+	}
+}
+
+func TestBufferShrink(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			for i := 0; i < 1<<14; i++ {
+				binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+			}
+			grown := buf.curSz
+			buf.Compact(func(slice []byte) bool {
+				return binary.BigEndian.Uint64(slice) < 10
+			})
+			require.NoError(t, buf.Shrink())
+			require.Less(t, buf.curSz, grown)
+			require.Equal(t, pageSize, buf.curSz)
+
+			var got []uint64
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				got = append(got, binary.BigEndian.Uint64(slice))
+				return nil
+			}))
+			require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, got)
+
+			// Still usable after shrinking.
+			for i := 0; i < 1<<10; i++ {
+				binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+			}
+			require.Equal(t, 10+1<<10, buf.NumSlices())
+
+			// Nothing to give back.
+			sz := buf.curSz
+			require.NoError(t, buf.Shrink())
+			require.Equal(t, sz, buf.curSz)
+		})
+	}
+}
+
+func TestBufferCompact(t *testing.T) {
+	keep := func(slice []byte) bool {
+		return binary.BigEndian.Uint64(slice)%3 != 0
+	}
+	compacts := map[string]func(buf *Buffer){
+		"serial":   func(buf *Buffer) { buf.Compact(keep) },
+		"parallel": func(buf *Buffer) { buf.CompactParallel(keep, 4) },
+		"truncate": func(buf *Buffer) { require.NoError(t, buf.CompactAndTruncate(keep)) },
+	}
+	for mode, compact := range compacts {
+		bufs := newTestBuffers(t, 1<<10)
+		for _, buf := range bufs {
+			name := fmt.Sprintf("Using buffer type: %s, %s", buf.bufType, mode)
+			t.Run(name, func(t *testing.T) {
+				var exp []uint64
+				for i := 0; i < 10000; i++ {
+					binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+					if i%3 != 0 {
+						exp = append(exp, uint64(i))
+					}
+				}
+				compact(buf)
+
+				var got []uint64
+				require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+					got = append(got, binary.BigEndian.Uint64(slice))
+					return nil
+				}))
+				require.Equal(t, exp, got)
+			})
+		}
+	}
+}
+
+func TestBufferCompactAndTruncate(t *testing.T) {
+	buf, err := NewBufferTmp("", 64)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, buf.Release()) }()
+	for i := 0; i < 1<<16; i++ {
+		binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+	}
+	require.NoError(t, buf.CompactAndTruncate(func(slice []byte) bool {
+		return binary.BigEndian.Uint64(slice) < 100
+	}))
+	fi, err := buf.mmapFile.Fd.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(pageSize), fi.Size())
+	require.Equal(t, pageSize, buf.curSz)
+
+	// The buffer can still grow after being truncated.
+	buf.WriteSlice(make([]byte, 1<<20))
+	require.Equal(t, 100+1, len(buf.SliceOffsets()))
+
+	// Only the files of UseMmap buffers are truncated, Calloc buffers keep their memory.
+	cbuf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, cbuf.Release()) }()
+	cbuf.Allocate(1 << 20)
+	cbuf.Reset()
+	sz := cbuf.Capacity()
+	require.NoError(t, cbuf.CompactAndTruncate(func([]byte) bool { return true }))
+	require.NoError(t, cbuf.ShrinkToFit())
+	require.Equal(t, sz, cbuf.Capacity())
+}
+
+func TestBufferSliceAllocateCap(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.WriteSlice([]byte("first"))
+			slice, setLen := buf.SliceAllocateCap(100)
+			require.Len(t, slice, 100)
+			n := copy(slice, "second")
+			offset := setLen(n)
+			buf.WriteSlice([]byte("third"))
+
+			got, _ := buf.Slice(offset)
+			require.Equal(t, []byte("second"), got)
+			var all []string
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				all = append(all, string(slice))
+				return nil
+			}))
+			require.Equal(t, []string{"first", "second", "third"}, all)
+
+			_, setLen = buf.SliceAllocateCap(10)
+			require.Panics(t, func() { setLen(11) })
+			buf.WriteSlice([]byte("fourth"))
+			require.Panics(t, func() { setLen(5) })
+		})
+	}
+}
+
+func TestBufferSliceCRC(t *testing.T) {
+	bufs := newTestBuffers(t, 1<<10)
+	for _, buf := range bufs {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			var exp [][]byte
+			for i := 0; i < 100; i++ {
+				data := make([]byte, 1+rand.Intn(32))
+				rand.Read(data)
+				slice, seal := buf.SliceAllocateWithCRC(len(data))
+				copy(slice, data)
+				seal()
+				exp = append(exp, data)
+			}
+
+			var got [][]byte
+			require.NoError(t, buf.SliceIterateVerified(func(slice []byte) error {
+				got = append(got, append([]byte{}, slice...))
+				return nil
+			}))
+			require.Equal(t, exp, got)
+
+			// Flip a byte in the first slice.
+			buf.Bytes()[4] ^= 0xff
+			_, _, err := buf.ReadSliceVerified(buf.StartOffset())
+			require.Error(t, err)
+			require.Error(t, buf.SliceIterateVerified(func([]byte) error { return nil }))
+		})
+	}
+}
+
+func TestBufferTmpCleanupOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The file can be truncated to this size, but not mmaped, so construction fails.
+	lift := limitAddressSpace(t, 256<<20)
+	_, err = NewBufferTmp(dir, 1<<30)
+	lift()
+	require.Error(t, err)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	// Same for the tmpfiles created when a Calloc buffer moves over to mmap.
+	buf := NewBuffer(64, "test").WithAutoMmap(1<<10, dir)
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.WriteSlice([]byte("kept"))
+	lift = limitAddressSpace(t, 256<<20)
+	_, err = buf.SliceAllocateE(1 << 30)
+	lift()
+	require.Error(t, err)
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+	require.Equal(t, UseCalloc, buf.Type())
+	slice, _ := buf.Slice(buf.StartOffset())
+	require.Equal(t, []byte("kept"), slice)
+}
+
+func TestBufferFileSize(t *testing.T) {
+	buf := NewBuffer(1<<10, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	_, err := buf.FileSize()
+	require.Error(t, err)
+
+	mbuf, err := NewBufferTmp("", 64<<20)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, mbuf.Release()) }()
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	mbuf.Write(data)
+	require.NoError(t, mbuf.mmapFile.Sync())
+
+	sz, err := mbuf.FileSize()
+	require.NoError(t, err)
+	require.Greater(t, sz, int64(0))
+	require.LessOrEqual(t, sz, int64(64<<20))
+}
+
+func TestBufferAllocGate(t *testing.T) {
+	buf := NewBuffer(1<<10, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	var requested []int
+	AllocGate = func(sz int) error {
+		requested = append(requested, sz)
+		if sz > 1<<20 {
+			return errors.New("over budget")
+		}
+		return nil
+	}
+	defer func() { AllocGate = nil }()
+
+	_, err := buf.SliceAllocateE(1 << 10)
+	require.NoError(t, err)
+	_, err = buf.SliceAllocateE(1 << 20)
+	require.Error(t, err)
+	require.Panics(t, func() { buf.Grow(1 << 20) })
+	require.Equal(t, 4+1<<10, buf.LenNoPadding())
+	require.Len(t, requested, 3)
+}
+
+func TestBufferRecordEncoder(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	var offsets []int
+	for i := 0; i < 100; i++ {
+		enc := buf.RecordEncoder(4)
+		enc.Uint64(uint64(i))
+		enc.Bytes(bytes.Repeat([]byte{'a'}, i))
+		enc.Uint32(uint32(i))
+		offsets = append(offsets, enc.Finish())
+	}
+	for i, off := range offsets {
+		slice, _ := buf.Slice(off)
+		require.Len(t, slice, 12+i)
+		require.Equal(t, uint64(i), binary.BigEndian.Uint64(slice))
+		require.Equal(t, bytes.Repeat([]byte{'a'}, i), slice[8:8+i])
+		require.Equal(t, uint32(i), binary.BigEndian.Uint32(slice[8+i:]))
+	}
+}
+
+func TestBufferResetKeepHeader(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	buf.Write([]byte("header"))
+	buf.Write([]byte("body"))
+	buf.ResetKeepHeader(6)
+	require.Equal(t, []byte("header"), buf.Bytes())
+	buf.Write([]byte("next"))
+	require.Equal(t, []byte("headernext"), buf.Bytes())
+	require.Panics(t, func() { buf.ResetKeepHeader(11) })
+}
+
+func TestBufferReadOffClamped(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	readAll := func() string {
+		data, err := ioutil.ReadAll(buf)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	// Reading past the header and resetting to it reads the bytes written afterwards.
+	buf.Write([]byte("headerbody"))
+	require.Equal(t, "headerbody", readAll())
+	buf.ResetKeepHeader(6)
+	buf.Write([]byte("next"))
+	require.Equal(t, "next", readAll())
+
+	// Same for the methods which drop slices.
+	lowering := map[string]func(){
+		"Compact": func() { buf.Compact(func([]byte) bool { return false }) },
+		"CompactParallel": func() {
+			buf.CompactParallel(func([]byte) bool { return false }, 2)
+		},
+		"Deduplicate": func() { buf.Deduplicate(bytes.Equal) },
+		"DropTombstones": func() {
+			buf.WriteTombstone([]byte("a"))
+			buf.DropTombstones(func(slice []byte) []byte { return slice })
+		},
+		"VerifyChecksum": func() {
+			buf.WriteChecksum()
+			readAll()
+			require.True(t, buf.VerifyChecksum())
+		},
+	}
+	for name, lower := range lowering {
+		buf.Reset()
+		buf.WriteSlice([]byte("a"))
+		buf.WriteSlice([]byte("a"))
+		readAll()
+		lower()
+		require.Equal(t, buf.LenNoPadding(), buf.readOff, name)
+		buf.Write([]byte("next"))
+		require.Equal(t, "next", readAll(), name)
+	}
+}
+
+func TestBufferWriteAt(t *testing.T) {
+	bufs := newTestBuffers(t, 1<<16)
+	for _, buf := range bufs {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			buf.WithSyncWriteAt(true)
+			buf.Write(make([]byte, 8192))
+			n, err := buf.WriteAt([]byte("hello"), int64(buf.StartOffset()+4094))
+			require.NoError(t, err)
+			require.Equal(t, 5, n)
+			require.Equal(t, []byte("hello"), buf.Bytes()[4094:4099])
+
+			_, err = buf.WriteAt([]byte("x"), 0)
+			require.Error(t, err)
+			_, err = buf.WriteAt([]byte("xx"), int64(buf.curSz-1))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestBufferSliceIterateCopy(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	for i := 1; i <= 10; i++ {
+		buf.WriteSlice(bytes.Repeat([]byte{byte(i)}, i))
+	}
+
+	var count int
+	scratch, err := buf.SliceIterateCopy(nil, func(slice []byte) error {
+		count++
+		require.Equal(t, bytes.Repeat([]byte{byte(count)}, count), slice)
+		// Mutating the copy must not affect the buffer.
+		slice[0] = 0
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 10, count)
+	require.GreaterOrEqual(t, cap(scratch), 10)
+
+	first, _ := buf.Slice(buf.StartOffset())
+	require.Equal(t, []byte{1}, first)
+}
+
+func TestBufferGrowBurst(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	require.Equal(t, 1, buf.Stats().GrowFactor)
+
+	for i := 0; i < 1<<20; i++ {
+		buf.Write([]byte{byte(i)})
+	}
+	stats := buf.Stats()
+	require.Greater(t, stats.GrowFactor, 1)
+	// Plain doubling would need 14 reallocations to get from 64 bytes to 1MB.
+	require.Less(t, stats.Reallocs, 14)
+
+	// Once the burst is over, the factor decays back.
+	buf.lastGrow = time.Now().Add(-time.Second)
+	buf.Grow(buf.curSz)
+	require.Less(t, buf.Stats().GrowFactor, stats.GrowFactor)
+}
+
+func TestBufferGrowMaxSize(t *testing.T) {
+	const maxSz = 1 << 20
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.WithMaxSize(maxSz)
+			data := make([]byte, 100)
+			for buf.LenWithPadding()+len(data) <= maxSz {
+				buf.Write(data)
+				require.LessOrEqual(t, buf.Capacity(), maxSz)
+			}
+			// No burst of grows makes a buffer with a max size grow faster.
+			require.Equal(t, 1, buf.Stats().GrowFactor)
+			require.Panics(t, func() { buf.Write(data) })
+		})
+	}
+}
+
+func TestBufferPipeThrough(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	data := bytes.Repeat([]byte("ristretto"), 1<<18)
+	buf.Write(data)
+
+	var out bytes.Buffer
+	n, err := buf.PipeThrough(&out, func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Less(t, out.Len(), len(data))
+
+	r, err := gzip.NewReader(&out)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestBufferSoftLimit(t *testing.T) {
+	buf := NewBuffer(64, "test").WithSoftMaxSize(8 + 100).WithMaxSize(8 + 200)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	var count int
+	for !buf.WouldExceedSoftLimit(6) {
+		buf.SliceAllocate(6)
+		count++
+	}
+	require.Equal(t, 10, count)
+	require.NotPanics(t, func() { buf.SliceAllocate(6) })
+
+	// Timestamped slices take 8 more bytes each, which the check has to account for.
+	tsBuf := NewBuffer(64, "test").WithTimestamps().WithSoftMaxSize(8 + 100).WithMaxSize(8 + 200)
+	defer func() { require.NoError(t, tsBuf.Release()) }()
+	count = 0
+	for !tsBuf.WouldExceedSoftLimit(6) {
+		tsBuf.SliceAllocate(6)
+		count++
+	}
+	require.Equal(t, 5, count)
+	require.LessOrEqual(t, int(tsBuf.offset), 8+100)
+}
+
+func TestBufferReserveMapping(t *testing.T) {
+	buf, err := NewBufferTmp("", 1<<10)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.WithMaxSize(64 << 20)
+	require.NoError(t, buf.ReserveMapping())
+
+	buf.Write([]byte("hello"))
+	ptr := &buf.buf[0]
+	slice := buf.Bytes()
+	for i := 0; i < 10; i++ {
+		buf.Write(make([]byte, 1<<20))
+	}
+	require.Greater(t, buf.curSz, 10<<20)
+	require.True(t, ptr == &buf.buf[0], "mapping must not move during Grow")
+	require.Equal(t, []byte("hello"), slice[:5])
+
+	fi, err := buf.mmapFile.Fd.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.curSz), fi.Size())
+	require.Less(t, buf.curSz, 64<<20)
+}
+
+func TestBufferReserveMappingFails(t *testing.T) {
+	buf, err := NewBufferTmp("", 1<<10)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.WriteSlice([]byte("hello"))
+
+	// Too big to be mapped, so the buffer must keep using its old mapping.
+	buf.WithMaxSize(1 << 30)
+	lift := limitAddressSpace(t, 256<<20)
+	err = buf.ReserveMapping()
+	lift()
+	require.Error(t, err)
+	buf.WriteSlice([]byte("world"))
+	slice, next := buf.Slice(buf.StartOffset())
+	require.Equal(t, []byte("hello"), slice)
+	slice, _ = buf.Slice(next)
+	require.Equal(t, []byte("world"), slice)
+}
+
+func TestBufferSortSliceByUint64Prefix(t *testing.T) {
+	buf := NewBuffer(1<<10, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	for i := 0; i < 10000; i++ {
+		b := buf.SliceAllocate(8 + rand.Intn(8))
+		binary.BigEndian.PutUint64(b, rand.Uint64())
+	}
+	require.NoError(t, buf.SortSliceByUint64Prefix())
+
+	var last uint64
+	require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+		key := binary.BigEndian.Uint64(slice)
+		require.GreaterOrEqual(t, key, last)
+		last = key
+		return nil
+	}))
+
+	buf.SliceAllocate(7)
+	require.Error(t, buf.SortSliceByUint64Prefix())
+}
+
+func TestBufferRadixSortUint64Prefix(t *testing.T) {
+	buf := NewBuffer(1<<10, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.RadixSortUint64Prefix()
+	for i := 0; i < 10000; i++ {
+		b := buf.SliceAllocate(16)
+		binary.BigEndian.PutUint64(b, uint64(rand.Intn(100))<<(8*uint(rand.Intn(8))))
+		binary.BigEndian.PutUint64(b[8:], uint64(i))
+	}
+	buf.RadixSortUint64Prefix()
+
+	// The order must be by key, and then by insertion order, as the sort is stable.
+	var lastKey, lastIdx uint64
+	require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+		key, idx := binary.BigEndian.Uint64(slice), binary.BigEndian.Uint64(slice[8:])
+		require.GreaterOrEqual(t, key, lastKey)
+		if key == lastKey {
+			require.GreaterOrEqual(t, idx, lastIdx)
+		}
+		lastKey, lastIdx = key, idx
+		return nil
+	}))
+
+	// Short slices fall back to sorting by the bytes available.
+	buf.Reset()
+	for _, s := range []string{"ccccccccc", "b", "aaaaaaaa"} {
+		buf.WriteSlice([]byte(s))
+	}
+	buf.RadixSortUint64Prefix()
+	var got []string
+	require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+		got = append(got, string(slice))
+		return nil
+	}))
+	require.Equal(t, []string{"aaaaaaaa", "b", "ccccccccc"}, got)
+}
+
+func TestBufferSortSliceRadix(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			// 3 byte keys, followed by the insertion order, with varying lengths.
+			for i := 0; i < 10000; i++ {
+				slice := buf.SliceAllocate(7 + rand.Intn(10))
+				copy(slice, []byte{byte(rand.Intn(4)), byte(rand.Intn(256)), byte(rand.Intn(8))})
+				binary.BigEndian.PutUint32(slice[3:], uint32(i))
+			}
+			buf.SortSliceRadix(3)
+			var last []byte
+			var lastIdx uint32
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				cmp := bytes.Compare(last, slice[:3])
+				require.LessOrEqual(t, cmp, 0)
+				idx := binary.BigEndian.Uint32(slice[3:])
+				if cmp == 0 {
+					require.Greater(t, idx, lastIdx)
+				}
+				last, lastIdx = slice[:3], idx
+				return nil
+			}))
+			require.Equal(t, 10000, buf.NumSlices())
+
+			// Keys longer than 8 bytes take several rounds of passes.
+			buf.Reset()
+			var want [][]byte
+			for i := 0; i < 1000; i++ {
+				slice := buf.SliceAllocate(12)
+				rand.Read(slice)
+				slice[0] = byte(rand.Intn(2))
+				want = append(want, append([]byte{}, slice...))
+			}
+			sort.SliceStable(want, func(i, j int) bool {
+				return bytes.Compare(want[i][:10], want[j][:10]) < 0
+			})
+			buf.SortSliceRadix(10)
+			var i int
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				require.Equal(t, want[i], slice)
+				i++
+				return nil
+			}))
+
+			// Short slices fall back to sorting by the bytes available, stably.
+			buf.Reset()
+			for _, s := range []string{"ccc2", "b", "ccc1", "aaa"} {
+				buf.WriteSlice([]byte(s))
+			}
+			buf.SortSliceRadix(3)
+			var got []string
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				got = append(got, string(slice))
+				return nil
+			}))
+			require.Equal(t, []string{"aaa", "b", "ccc2", "ccc1"}, got)
+			require.Panics(t, func() { buf.SortSliceRadix(0) })
+		})
+	}
+}
+
+func TestBufferReleaseSecure(t *testing.T) {
+	buf := NewBuffer(1<<10, "test")
+	buf.Write([]byte("secret"))
+	mem := buf.buf
+	require.NoError(t, buf.ReleaseSecure())
+	// Without jemalloc, Free is a no-op, so the memory can still be inspected.
+	if NumAllocBytes() == 0 {
+		require.Equal(t, make([]byte, len(mem)), mem)
+	}
+}
+
+func TestBufferReleaseTwice(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.Write([]byte("data"))
+			require.NoError(t, buf.Release())
+			require.NotPanics(t, func() {
+				require.NoError(t, buf.Release())
+				require.NoError(t, buf.ReleaseSecure())
+			})
+		})
+	}
+}
+
+func TestBufferResetZero(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			secret := bytes.Repeat([]byte("secret"), 100)
+			buf.Write(secret)
+			end := buf.LenWithPadding()
+			buf.ResetZero()
+			require.Equal(t, 0, buf.LenNoPadding())
+			require.Equal(t, make([]byte, end), buf.buf[:end])
+
+			buf.Write([]byte("data"))
+			require.Equal(t, []byte("data"), buf.Bytes())
+		})
+	}
+}
+
+func TestBufferAdvise(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.Allocate(1 << 20)
+			for _, advice := range []MadviseAdvice{
+				AdviseSequential, AdviseRandom, AdviseWillNeed, AdviseNormal} {
+				require.NoError(t, buf.Advise(advice))
+			}
+		})
+	}
+}
+
+func TestBufferWriteAtGrow(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			start := buf.StartOffset()
+			n, err := buf.WriteAtGrow([]byte("tail"), start+1<<12)
+			require.NoError(t, err)
+			require.Equal(t, 4, n)
+			require.Equal(t, 1<<12+4, buf.LenNoPadding())
+			require.Equal(t, make([]byte, 1<<12), buf.Bytes()[:1<<12])
+
+			// Writing within the written bytes doesn't change the length.
+			_, err = buf.WriteAtGrow([]byte("head"), start)
+			require.NoError(t, err)
+			require.Equal(t, 1<<12+4, buf.LenNoPadding())
+			require.Equal(t, []byte("head"), buf.Bytes()[:4])
+			require.Equal(t, []byte("tail"), buf.Bytes()[1<<12:])
+
+			_, err = buf.WriteAtGrow([]byte("x"), start-1)
+			require.Error(t, err)
+
+			buf.WithMaxSize(1 << 14)
+			_, err = buf.WriteAtGrow([]byte("x"), 1<<14)
+			require.Error(t, err)
+			require.Equal(t, 1<<12+4, buf.LenNoPadding())
+		})
+	}
+}
+
+func TestBufferWriteInts(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			var offsets []int
+			for i := 0; i < 1000; i++ {
+				offsets = append(offsets, buf.LenWithPadding())
+				switch i % 3 {
+				case 0:
+					buf.WriteUint32(uint32(i))
+				case 1:
+					buf.WriteUint64(uint64(i) << 40)
+				case 2:
+					require.Equal(t, binary.PutUvarint(make([]byte, 10), uint64(i)<<20),
+						buf.WriteUvarint(uint64(i)<<20))
+				}
+			}
+			for i, off := range offsets {
+				switch i % 3 {
+				case 0:
+					require.Equal(t, uint32(i), buf.ReadUint32At(off))
+				case 1:
+					require.Equal(t, uint64(i)<<40, buf.ReadUint64At(off))
+				case 2:
+					v, n := buf.ReadUvarintAt(off)
+					require.Equal(t, uint64(i)<<20, v)
+					if i+1 < len(offsets) {
+						require.Equal(t, offsets[i+1]-off, n)
+					}
+				}
+			}
+			require.Equal(t, []byte{0, 0, 0, 0}, buf.Bytes()[:4])
+			end := buf.LenWithPadding()
+			require.Panics(t, func() { buf.ReadUint32At(end - 2) })
+			require.Panics(t, func() { buf.ReadUint64At(buf.StartOffset() - 1) })
+			require.Panics(t, func() { buf.ReadUvarintAt(end) })
+		})
+	}
+}
+
+func TestBufferTruncate(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.Write([]byte("committed"))
+			buf.Write(bytes.Repeat([]byte("speculative"), 1000))
+			require.NoError(t, buf.Truncate(9))
+			require.Equal(t, []byte("committed"), buf.Bytes())
+
+			buf.Write([]byte(" more"))
+			require.Equal(t, []byte("committed more"), buf.Bytes())
+
+			require.Error(t, buf.Truncate(15))
+			require.Error(t, buf.Truncate(-1))
+			require.NoError(t, buf.Truncate(0))
+			require.True(t, buf.IsEmpty())
+
+			if buf.bufType == UseMmap {
+				require.NoError(t, buf.Shrink())
+				fi, err := buf.mmapFile.Fd.Stat()
+				require.NoError(t, err)
+				require.Equal(t, int64(pageSize), fi.Size())
+			}
+		})
+	}
+}
+
+func TestBufferReadAtCopy(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.Write([]byte("hello world"))
+			start := buf.StartOffset()
+			got, err := buf.ReadAtCopy(5, start+6)
+			require.NoError(t, err)
+			require.Equal(t, []byte("world"), got)
+
+			// The copy survives writes and reallocations.
+			copy(buf.Data(start+6), "WORLD")
+			buf.Allocate(1 << 16)
+			require.Equal(t, []byte("world"), got)
+
+			_, err = buf.ReadAtCopy(1, start-1)
+			require.Error(t, err)
+			_, err = buf.ReadAtCopy(1, buf.LenWithPadding())
+			require.Error(t, err)
+			_, err = buf.ReadAtCopy(-1, start)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestBufferSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffer")
+	buf, err := NewBufferPersistent(path, 64)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	data := bytes.Repeat([]byte("durable"), 1<<10)
+	buf.Write(data)
+	require.NoError(t, buf.Sync())
+
+	// Read the file back independently of the mapping.
+	got, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, data, got[buf.StartOffset():buf.LenWithPadding()])
+
+	calloc := NewBuffer(64, "test")
+	defer func() { require.NoError(t, calloc.Release()) }()
+	require.NoError(t, calloc.Sync())
+}
+
+func TestBufferReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffer")
+	buf, err := NewBufferPersistent(path, 64)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(100-i))
+	}
+	end := buf.LenWithPadding()
+	require.NoError(t, buf.Release())
+	require.NoError(t, os.Truncate(path, int64(end)))
+
+	ro, err := NewBufferReadOnly(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ro.Release()) }()
+	require.Equal(t, 100, ro.NumSlices())
+	first, _ := ro.Slice(ro.StartOffset())
+	require.Equal(t, uint64(100), binary.BigEndian.Uint64(first))
+
+	_, err = ro.Write([]byte("data"))
+	require.Error(t, err)
+	_, err = ro.WriteAt([]byte("data"), int64(ro.StartOffset()))
+	require.Error(t, err)
+	_, err = ro.SliceAllocateE(8)
+	require.Error(t, err)
+	less := func(l, r []byte) bool { return bytes.Compare(l, r) < 0 }
+	require.Panics(t, func() { ro.SortSlice(less) })
+
+	sorted := NewBuffer(64, "test")
+	defer func() { require.NoError(t, sorted.Release()) }()
+	ro.SortSliceInto(sorted, less)
+	require.True(t, sorted.IsSorted(less))
+	require.Equal(t, 100, sorted.NumSlices())
+
+	// Writes must keep failing, rather than panicking, once the buffer is released.
+	require.NoError(t, ro.Release())
+	_, err = ro.Write([]byte("data"))
+	require.Error(t, err)
+}
+
+func TestBufferReleaseKeepFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	buf, err := NewBufferTmp(dir, 64)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+	}
+	path, end := buf.mmapFile.Fd.Name(), buf.LenWithPadding()
+	require.NoError(t, buf.ReleaseKeepFile())
+	require.NoError(t, buf.ReleaseKeepFile())
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(end), fi.Size())
+
+	ro, err := NewBufferReadOnly(path)
+	require.NoError(t, err)
+	require.Equal(t, end, ro.LenWithPadding())
+	require.Equal(t, 100, ro.NumSlices())
+	require.NoError(t, ro.ReleaseKeepFile())
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+
+	calloc := NewBuffer(64, "test")
+	require.NoError(t, calloc.ReleaseKeepFile())
+}
+
+func TestBufferChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buffer")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffer")
+	buf, err := NewBufferPersistent(path, 64)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		binary.BigEndian.PutUint64(buf.SliceAllocate(8), uint64(i))
+	}
+	data := buf.BytesCopy()
+	buf.WriteChecksum()
+	require.NoError(t, buf.ReleaseKeepFile())
+
+	ro, err := NewBufferReadOnly(path)
+	require.NoError(t, err)
+	require.True(t, ro.VerifyChecksum())
+	require.Equal(t, data, ro.Bytes())
+	require.Equal(t, 1000, ro.NumSlices())
+	// The trailer is gone, so there's nothing left to verify.
+	require.False(t, ro.VerifyChecksum())
+	require.NoError(t, ro.Release())
+
+	// Flip a byte.
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	raw[100] ^= 1
+	require.NoError(t, ioutil.WriteFile(path, raw, 0666))
+	ro, err = NewBufferReadOnly(path)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ro.Release()) }()
+	end := ro.LenWithPadding()
+	require.False(t, ro.VerifyChecksum())
+	require.Equal(t, end, ro.LenWithPadding())
+
+	empty := NewBuffer(64, "test")
+	defer func() { require.NoError(t, empty.Release()) }()
+	require.False(t, empty.VerifyChecksum())
+	empty.WriteChecksum()
+	require.True(t, empty.VerifyChecksum())
+	require.True(t, empty.IsEmpty())
+}
+
+func TestBufferSliceAllocateFromReader(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	data := make([]byte, 1<<16)
+	rand.Read(data)
+	// iotest.OneByteReader forces short reads.
+	slice, err := buf.SliceAllocateFromReader(iotest.OneByteReader(bytes.NewReader(data)), len(data))
+	require.NoError(t, err)
+	require.Equal(t, data, slice)
+
+	off := buf.LenWithPadding()
+	_, err = buf.SliceAllocateFromReader(bytes.NewReader(data[:10]), 20)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	require.Equal(t, off, buf.LenWithPadding())
+}
+
+func TestBufferReserve(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.Write([]byte("abc"))
+			buf.Reserve(1 << 16)
+			require.GreaterOrEqual(t, buf.curSz, buf.LenWithPadding()+1<<16)
+			require.Equal(t, 3, buf.LenNoPadding())
+
+			reallocs := buf.Stats().Reallocs
+			for i := 0; i < 1<<12; i++ {
+				buf.Write([]byte("0123456789abcdef"))
+			}
+			require.Equal(t, reallocs, buf.Stats().Reallocs)
+		})
+	}
+}
+
+func TestBufferTryGrow(t *testing.T) {
+	buf := NewBuffer(64, "test").WithMaxSize(1 << 10)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	require.NoError(t, buf.TryGrow(1000))
+	buf.Allocate(1000)
+	err := buf.TryGrow(100)
+	var maxErr *MaxSizeError
+	require.True(t, errors.As(err, &maxErr))
+	require.Equal(t, MaxSizeError{MaxSize: 1 << 10, Offset: 1008, N: 100}, *maxErr)
+	require.Equal(t, "z.Buffer max size exceeded: 1024 offset: 1008 grow: 100", err.Error())
+	require.Equal(t, 1008, buf.LenWithPadding())
+}
+
+func TestBufferSafeBuild(t *testing.T) {
+	buf := NewBuffer(64, "test").WithMaxSize(1 << 10)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	err := SafeBuild(buf, func(buf *Buffer) {
+		for i := 0; i < 1<<10; i++ {
+			buf.WriteSlice([]byte("abcd"))
+		}
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "max size exceeded")
+
+	require.NoError(t, SafeBuild(buf, func(buf *Buffer) { buf.Reset() }))
+	require.Panics(t, func() {
+		SafeBuild(buf, func(*Buffer) { panic("other") })
+	})
+}
+
+func TestBufferResidentBytes(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mincore is only supported on linux")
+	}
+	buf, err := NewBufferTmp("", 64<<20)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	buf.Write(make([]byte, 1<<20))
+	res, err := buf.ResidentBytes()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, res, int64(1<<20))
+	require.Less(t, res, int64(64<<20))
+
+	cbuf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, cbuf.Release()) }()
+	_, err = cbuf.ResidentBytes()
+	require.Error(t, err)
+}
+
+func TestBufferMinGrowth(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.Allocate(100)
+	require.Equal(t, 64+pageSize, buf.curSz)
+
+	buf.WithMinGrowth(1 << 20)
+	buf.Allocate(pageSize)
+	require.Equal(t, 64+pageSize+1<<20, buf.curSz)
+}
+
+func TestBufferGrowStrategy(t *testing.T) {
+	tests := []struct {
+		strategy GrowStrategy
+		sizes    []int
+	}{
+		{Doubling, []int{64 + 64 + 100, 228 + 228 + 100}},
+		{Exact, []int{8 + 100, 8 + 200}},
+		{Linear(256), []int{64 + 256, 64 + 512}},
+		{GrowthFunc(func(cur, need int) int { return 2 * need }), []int{2 * 108, 2 * 316}},
+		// Sizes too small to fit the requested bytes get corrected.
+		{GrowthFunc(func(cur, need int) int { return cur + cur/2 }), []int{108, 208}},
+	}
+	for _, tc := range tests {
+		buf := NewBuffer(64, "test").WithGrowStrategy(tc.strategy)
+		var sizes []int
+		for i := 0; i < 2; i++ {
+			buf.Grow(100)
+			sizes = append(sizes, buf.curSz)
+			buf.Allocate(100)
+			buf.Allocate(buf.curSz - buf.LenWithPadding())
+		}
+		require.Equal(t, tc.sizes, sizes)
+		require.Equal(t, 1, buf.Stats().GrowFactor)
+		require.NoError(t, buf.Release())
+	}
+}
+
+func TestBufferClone(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.WithMaxSize(1 << 20)
+			for i := 0; i < 100; i++ {
+				buf.WriteSlice([]byte(fmt.Sprintf("slice-%d", i)))
+			}
+			orig := buf.BytesCopy()
+
+			clone, err := buf.Clone()
+			require.NoError(t, err)
+			require.Equal(t, buf.bufType, clone.bufType)
+			require.Equal(t, 1<<20, clone.maxSz)
+			require.Equal(t, orig, clone.Bytes())
+
+			clone.WriteSlice([]byte("more"))
+			clone.Compact(func(slice []byte) bool {
+				return slice[len(slice)-1] == '7'
+			})
+			require.Equal(t, orig, buf.Bytes())
+			require.Equal(t, 10, clone.NumSlices())
+
+			require.NoError(t, clone.Release())
+			require.Equal(t, orig, buf.Bytes())
+		})
+	}
+}
+
+func TestNewBufferFromBytes(t *testing.T) {
+	src := NewBuffer(64, "test")
+	defer func() { require.NoError(t, src.Release()) }()
+	for i := 0; i < 1000; i++ {
+		binary.BigEndian.PutUint64(src.SliceAllocate(8), rand.Uint64())
+	}
+	data := src.BytesCopy()
+
+	buf := NewBufferFromBytes(data)
+	require.Equal(t, 1000, buf.NumSlices())
+	less := func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+	buf.SortSlice(less)
+	require.True(t, buf.IsSorted(less))
+	// The buffer sorted data in place.
+	require.Equal(t, data, buf.Bytes())
+	require.True(t, NewBufferFromBytes(data).IsSorted(less))
+
+	// Writes fit within the capacity of data, but can't grow beyond it.
+	buf = NewBufferFromBytes(make([]byte, 0, 10))
+	buf.WriteSlice([]byte("small"))
+	require.Equal(t, 1, buf.NumSlices())
+	require.Panics(t, func() { buf.WriteSlice([]byte("large")) })
+	require.NoError(t, buf.Release())
+}
+
+func TestBufferMerge(t *testing.T) {
+	other := NewBuffer(64, "test")
+	defer func() { require.NoError(t, other.Release()) }()
+	for i := 0; i < 10; i++ {
+		other.WriteSlice([]byte(fmt.Sprintf("other-%d", i)))
+	}
+
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			empty := NewBuffer(64, "test")
+			defer func() { require.NoError(t, empty.Release()) }()
+			require.NoError(t, buf.Merge(empty))
+			require.True(t, buf.IsEmpty())
+
+			buf.WriteSlice([]byte("first"))
+			require.NoError(t, buf.Merge(other))
+			require.Equal(t, 11, buf.NumSlices())
+			last, _ := buf.Slice(buf.SliceOffsets()[10])
+			require.Equal(t, []byte("other-9"), last)
+
+			buf.WithMaxSize(buf.LenWithPadding() + 10)
+			var maxErr *MaxSizeError
+			require.True(t, errors.As(buf.Merge(other), &maxErr))
+			require.Equal(t, 11, buf.NumSlices())
+
+			varint := NewBuffer(64, "test").WithVarintLen()
+			defer func() { require.NoError(t, varint.Release()) }()
+			varint.WriteSlice([]byte("v"))
+			require.Error(t, buf.Merge(varint))
+		})
+	}
+
+	// Merging a buffer with itself doubles its slices, even if it has to grow. Poisoning the old
+	// memory on Grow catches reads from it.
+	self := NewBuffer(64, "test").WithPoisonOnGrow(true)
+	defer func() { require.NoError(t, self.Release()) }()
+	var n int
+	for ; 2*self.LenWithPadding() <= self.Capacity(); n++ {
+		self.WriteSlice([]byte(fmt.Sprintf("self-%d", n)))
+	}
+	want := append(self.BytesCopy(), self.Bytes()...)
+	require.NoError(t, self.Merge(self))
+	require.Equal(t, want, self.Bytes())
+	require.Equal(t, 2*n, self.NumSlices())
+}
+
+func TestBufferSearch(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			less := func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+			offset, found := buf.Search(buf.BuildIndex(), []byte("a"), less)
+			require.False(t, found)
+			require.Equal(t, buf.StartOffset(), offset)
+
+			for i := 0; i < 1000; i += 2 {
+				buf.WriteSlice([]byte(fmt.Sprintf("key-%03d", i)))
+			}
+			index := buf.BuildIndex()
+			require.Len(t, index, 500)
+
+			search := func(key string) (string, bool) {
+				offset, found := buf.Search(index, []byte(key), less)
+				slice, _ := buf.Slice(offset)
+				return string(slice), found
+			}
+			for _, tc := range []struct {
+				key, want string
+				found     bool
+			}{
+				{"key-000", "key-000", true},
+				{"key-998", "key-998", true},
+				{"key-500", "key-500", true},
+				{"key-001", "key-002", false},
+				{"a", "key-000", false},
+			} {
+				got, found := search(tc.key)
+				require.Equal(t, tc.want, got, tc.key)
+				require.Equal(t, tc.found, found, tc.key)
+			}
+			offset, found = buf.Search(index, []byte("z"), less)
+			require.False(t, found)
+			require.Equal(t, buf.LenWithPadding(), offset)
+		})
+	}
+}
+
+func TestBufferNumSlices(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			require.Zero(t, buf.NumSlices())
+			for i := 0; i < 1000; i++ {
+				buf.SliceAllocate(i % 7)
+			}
+			require.Equal(t, 1000, buf.NumSlices())
+			buf.Reset()
+			require.Zero(t, buf.NumSlices())
+		})
+	}
+}
+
+func TestBufferForEach(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	for _, s := range []string{"a", "", "b", "c"} {
+		buf.WriteSlice([]byte(s))
+	}
+
+	var got []string
+	errStop := errors.New("stop")
+	err := buf.ForEach(func(slice []byte) error {
+		got = append(got, string(slice))
+		if string(slice) == "b" {
+			return errStop
+		}
+		return nil
+	})
+	require.Equal(t, errStop, err)
+	require.Equal(t, []string{"a", "", "b"}, got)
+
+	// The slices alias the buffer.
+	require.NoError(t, buf.ForEach(func(slice []byte) error {
+		if len(slice) > 0 {
+			slice[0] = 'x'
+		}
+		return nil
+	}))
+	first, _ := buf.Slice(buf.StartOffset())
+	require.Equal(t, []byte("x"), first)
+}
+
+func TestBufferSliceIterator(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			it := buf.NewSliceIterator()
+			require.False(t, it.Next())
+
+			var want []string
+			for i := 0; i < 100; i++ {
+				s := fmt.Sprintf("slice-%d", i)
+				want = append(want, s)
+				buf.WriteSlice([]byte(s))
+				if i == 50 {
+					buf.WriteSlice(nil)
+				}
+			}
+			var got []string
+			for it = buf.NewSliceIterator(); it.Next(); {
+				slice, _ := buf.Slice(it.Offset())
+				require.Equal(t, it.Slice(), slice)
+				got = append(got, string(it.Slice()))
+			}
+			require.Equal(t, want, got)
+
+			// An iterator stopped early keeps the buffer from being released until closed.
+			it = buf.NewSliceIterator()
+			require.True(t, it.Next())
+			require.Error(t, buf.Release())
+			require.NoError(t, it.Close())
+			require.False(t, it.Next())
+		})
+	}
+}
+
+func TestBufferSliceIterateWithKey(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	for _, s := range []string{"a1", "b2", "a3", "c4"} {
+		buf.WriteSlice([]byte(s))
+	}
+
+	var calls int
+	keyOf := func(slice []byte) []byte {
+		calls++
+		return slice[:1]
+	}
+	var got []string
+	require.NoError(t, buf.SliceIterateWithKey(keyOf,
+		func(key, _ []byte) bool { return string(key) == "a" },
+		func(key, slice []byte) error {
+			require.Equal(t, "a", string(key))
+			got = append(got, string(slice))
+			return nil
+		}))
+	require.Equal(t, []string{"a1", "a3"}, got)
+	require.Equal(t, 4, calls)
+}
+
+func TestBufferBytesCopy(t *testing.T) {
+	buf := NewBuffer(64, "test").WithPoisonOnGrow(true)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	buf.Write([]byte("abc"))
+	stale, cp := buf.Bytes(), buf.BytesCopy()
+	buf.Write(make([]byte, 1<<10))
+	require.Equal(t, []byte("abc"), cp)
+	// Without jemalloc, Free is a no-op, so the stale memory can still be inspected.
+	if NumAllocBytes() == 0 {
+		require.Equal(t, []byte{0xde, 0xde, 0xde}, stale)
+	}
+}
+
+func TestBufferSortSliceInto(t *testing.T) {
+	src := NewBuffer(64, "test")
+	defer func() { require.NoError(t, src.Release()) }()
+	for i := 0; i < 1000; i++ {
+		binary.BigEndian.PutUint64(src.SliceAllocate(8), rand.Uint64())
+	}
+	orig := src.BytesCopy()
+	less := func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+
+	for _, dst := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", dst.bufType), func(t *testing.T) {
+			dst.WriteSlice([]byte("stale"))
+			src.SortSliceInto(dst, less)
+			require.Equal(t, orig, src.Bytes())
+			require.True(t, dst.IsSorted(less))
+			require.Equal(t, src.LenNoPadding(), dst.LenNoPadding())
+
+			src.SortSlice(less)
+			require.Equal(t, src.Bytes(), dst.Bytes())
+			copy(src.Bytes(), orig)
+		})
+	}
+
+	// The buffers must frame their slices the same way.
+	for name, dst := range map[string]*Buffer{
+		"varint":     NewBuffer(64, "test").WithVarintLen(),
+		"wide":       NewBuffer(64, "test").WithWideLen(),
+		"fixed":      NewBuffer(64, "test").WithFixedWidth(8),
+		"timestamps": NewBuffer(64, "test").WithTimestamps(),
+	} {
+		dst.Allocate(5)
+		require.Panics(t, func() { src.SortSliceInto(dst, less) }, name)
+		require.Equal(t, 5, dst.LenNoPadding(), name)
+		require.NoError(t, dst.Release())
+	}
+
+	// Sorting a buffer into itself sorts it in place, rather than dropping its slices.
+	src.SortSliceInto(src, less)
+	require.True(t, src.IsSorted(less))
+	require.Equal(t, 1000, src.NumSlices())
+	sorted := NewBufferSlice(orig)
+	sorted.SortSlice(less)
+	require.Equal(t, sorted.Bytes(), src.Bytes())
+}
+
+func TestBufferIsSorted(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	less := func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+
+	require.True(t, buf.IsSorted(less))
+	for i := 0; i < 100; i++ {
+		buf.WriteSlice([]byte(fmt.Sprintf("%03d", i)))
+	}
+	require.True(t, buf.IsSorted(less))
+	buf.WriteSlice([]byte("000"))
+	require.False(t, buf.IsSorted(less))
+	buf.SortSlice(less)
+	require.True(t, buf.IsSorted(less))
+}
+
+func TestBufferMmapDirs(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "mmap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	SetMmapDirs(dirs)
+	defer SetMmapDirs(nil)
+
+	for i := 0; i < 4; i++ {
+		buf, err := NewBufferTmp("", 64)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, buf.Release()) }()
+	}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+	}
+}
+
+func TestBufferThrashWarning(t *testing.T) {
+	buf := NewBuffer(64, "test").WithThrashWarning(3)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	// Renewing a buffer which didn't grow isn't a cycle.
+	require.NoError(t, buf.Renew())
+	for i := 1; i <= 3; i++ {
+		buf.Allocate(1 << 10)
+		require.NoError(t, buf.Renew())
+		require.Equal(t, i, buf.Stats().GrowShrinkCycles)
+		require.Equal(t, i == 3, buf.thrashWarn)
+	}
+}
+
+func TestBufferShrinkCycles(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.WithThrashWarning(3)
+			// Shrinking a buffer which didn't grow since isn't a cycle.
+			require.NoError(t, buf.Shrink())
+			for i := 1; i <= 3; i++ {
+				buf.Grow(1 << 16)
+				buf.Allocate(1 << 16)
+				buf.Reset()
+				require.NoError(t, buf.Shrink())
+				require.NoError(t, buf.Shrink())
+				require.Equal(t, i, buf.Stats().GrowShrinkCycles)
+				require.Equal(t, i == 3, buf.thrashWarn)
+			}
+		})
+	}
+}
+
+func TestBufferTombstones(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	put := func(key, val string) { buf.WriteSlice([]byte(key + "=" + val)) }
+	keyOf := func(slice []byte) []byte { return slice[:bytes.IndexByte(slice, '=')] }
+
+	put("a", "1")
+	put("b", "1")
+	buf.WriteTombstone([]byte("a"))
+	buf.WriteTombstone([]byte("c"))
+	put("b", "2")
+	buf.WriteTombstone([]byte("b"))
+	put("a", "2")
+
+	var tombstones int
+	buf.SliceIterate(func(slice []byte) error {
+		if IsTombstone(slice) {
+			tombstones++
+		}
+		return nil
+	})
+	require.Equal(t, 3, tombstones)
+
+	buf.DropTombstones(keyOf)
+	var got []string
+	buf.SliceIterate(func(slice []byte) error {
+		got = append(got, string(slice))
+		return nil
+	})
+	require.Equal(t, []string{"a=2"}, got)
+}
+
+func TestBufferRenew(t *testing.T) {
+	bufs := newTestBuffers(t, 1<<10)
+	bufs = append(bufs, NewBuffer(1<<10, "test").WithAutoMmap(1<<12, ""))
+	for _, buf := range bufs {
+		name := fmt.Sprintf("Using buffer type: %s", buf.bufType)
+		t.Run(name, func(t *testing.T) {
+			bufType := buf.bufType
+			buf.Write(bytes.Repeat([]byte{0xff}, 1<<13))
+			require.Greater(t, buf.curSz, 1<<10)
+
+			require.NoError(t, buf.Renew())
+			require.True(t, buf.IsEmpty())
+			require.Equal(t, 1<<10, buf.curSz)
+			require.Equal(t, bufType, buf.bufType)
+			require.Equal(t, make([]byte, 1<<10), buf.buf)
+			require.Zero(t, buf.Stats().Reallocs)
+		})
+	}
+	require.NoError(t, bufs[len(bufs)-1].Release())
+}
+
+func TestBufferRead(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			data := make([]byte, 1<<12)
+			rand.Read(data)
+			buf.Write(data)
+
+			var out bytes.Buffer
+			n, err := io.Copy(&out, iotest.HalfReader(buf))
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), n)
+			require.Equal(t, data, out.Bytes())
+
+			// Reading doesn't consume the bytes, and picks up new writes.
+			require.Equal(t, data, buf.Bytes())
+			buf.Write([]byte("more"))
+			rest, err := ioutil.ReadAll(buf)
+			require.NoError(t, err)
+			require.Equal(t, []byte("more"), rest)
+
+			require.NoError(t, buf.SeekRead(len(data)-2))
+			rest, err = ioutil.ReadAll(buf)
+			require.NoError(t, err)
+			require.Equal(t, append(data[len(data)-2:], "more"...), rest)
+			require.Error(t, buf.SeekRead(len(data)+5))
+
+			buf.Reset()
+			buf.Write([]byte("new"))
+			rest, err = ioutil.ReadAll(buf)
+			require.NoError(t, err)
+			require.Equal(t, []byte("new"), rest)
+		})
+	}
+}
+
+func TestBufferNewReader(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	buf.Write([]byte("hello"))
+
+	r := buf.NewReader()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), data)
+
+	require.Error(t, buf.Release())
+	require.NoError(t, r.Close())
+	require.NoError(t, r.Close())
+	_, err = r.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NoError(t, buf.Release())
+}
+
+type errWriter struct {
+	err error
+}
+
+func (w errWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestBufferWriteTo(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			data := make([]byte, 3*writeChunkSize+100)
+			rand.Read(data)
+			buf.Write(data)
+
+			var out bytes.Buffer
+			n, err := buf.WriteTo(&out)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), n)
+			require.Equal(t, buf.Bytes(), out.Bytes())
+
+			// The read cursor was moved to the end, until rewound.
+			n, err = buf.WriteTo(&out)
+			require.NoError(t, err)
+			require.Zero(t, n)
+			require.NoError(t, buf.SeekRead(0))
+
+			errTest := errors.New("test")
+			_, err = buf.WriteTo(errWriter{errTest})
+			require.Equal(t, errTest, err)
+		})
+	}
+}
+
+func TestBufferReadFrom(t *testing.T) {
+	data := make([]byte, 10<<20)
+	rand.Read(data)
+
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			buf.Write([]byte("head"))
+			n, err := buf.ReadFrom(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), n)
+			require.Equal(t, append([]byte("head"), data...), buf.Bytes())
+		})
+	}
+
+	buf := NewBuffer(64, "test").WithMaxSize(1 << 20)
+	defer func() { require.NoError(t, buf.Release()) }()
+	n, err := buf.ReadFrom(iotest.HalfReader(bytes.NewReader(data)))
+	require.Error(t, err)
+	require.Equal(t, int64(1<<20-buf.StartOffset()), n)
+	require.Equal(t, data[:n], buf.Bytes())
+
+	// Exactly filling the buffer up to its max size isn't an error.
+	buf.Reset()
+	_, err = buf.ReadFrom(bytes.NewReader(data[:n]))
+	require.NoError(t, err)
+}
+
+func TestBufferWriteBounded(t *testing.T) {
+	buf := NewBuffer(64, "test").WithMaxSize(8 + 100)
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	data := make([]byte, 60)
+	rand.Read(data)
+	n, err := buf.WriteBounded(data)
+	require.NoError(t, err)
+	require.Equal(t, 60, n)
+
+	n, err = buf.WriteBounded(data)
+	require.Equal(t, io.ErrShortWrite, err)
+	require.Equal(t, 40, n)
+	require.Equal(t, append(data, data[:40]...), buf.Bytes())
+
+	n, err = buf.WriteBounded(data)
+	require.Equal(t, io.ErrShortWrite, err)
+	require.Zero(t, n)
+}
+
+func TestBufferTimestamps(t *testing.T) {
+	buf := NewBuffer(64, "test").WithTimestamps()
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	before := time.Now().UnixNano()
+	for i := 0; i < 10; i++ {
+		copy(buf.SliceAllocate(3), fmt.Sprintf("%03d", i))
+	}
+	after := time.Now().UnixNano()
+
+	var i, last int64
+	for next := buf.StartOffset(); next >= 0; i++ {
+		var ts int64
+		var payload []byte
+		ts, payload, next = buf.SliceWithTime(next)
+		require.Equal(t, fmt.Sprintf("%03d", i), string(payload))
+		require.GreaterOrEqual(t, ts, before)
+		require.GreaterOrEqual(t, ts, last)
+		require.LessOrEqual(t, ts, after)
+		last = ts
+	}
+	require.Equal(t, int64(10), i)
+
+	buf.Compact(func(slice []byte) bool {
+		_, payload := SplitTimestamp(slice)
+		return payload[2] == '3'
+	})
+	_, payload, next := buf.SliceWithTime(buf.StartOffset())
+	require.Equal(t, "003", string(payload))
+	require.Equal(t, -1, next)
+}
+
+func TestBufferTimestampsCombined(t *testing.T) {
+	buf := NewBuffer(64, "test").WithTimestamps()
+	defer func() { require.NoError(t, buf.Release()) }()
+	keyOf := func(slice []byte) []byte { return slice[:bytes.IndexByte(slice, '=')] }
+
+	// Tombstones are told apart behind their timestamps.
+	buf.WriteSlice([]byte("a=1"))
+	buf.WriteTombstone([]byte("a"))
+	buf.WriteSlice([]byte("b=1"))
+	buf.DropTombstones(keyOf)
+	_, payload, next := buf.SliceWithTime(buf.StartOffset())
+	require.Equal(t, "b=1", string(payload))
+	require.Equal(t, -1, next)
+
+	// Records get a timestamp too.
+	buf.Reset()
+	before := time.Now().UnixNano()
+	enc := buf.RecordEncoder(4)
+	enc.Bytes([]byte("c="))
+	enc.Uint32(7)
+	off := enc.Finish()
+	buf.WriteSlice([]byte("d=1"))
+	ts, payload, next := buf.SliceWithTime(off)
+	require.GreaterOrEqual(t, ts, before)
+	require.Equal(t, append([]byte("c="), 0, 0, 0, 7), payload)
+	_, payload, next = buf.SliceWithTime(next)
+	require.Equal(t, "d=1", string(payload))
+	require.Equal(t, -1, next)
+
+	require.Panics(t, func() {
+		buf.Upsert([]byte("e"), []byte("e=1"), keyOf, func(a, b []byte) bool {
+			return bytes.Compare(a, b) < 0
+		})
+	})
+	require.Equal(t, 2, buf.NumSlices())
+}
+
+func TestBufferBytesByLabel(t *testing.T) {
+	buf := NewBuffer(1<<10, "index-build")
+	require.Equal(t, int64(1<<10), BufferBytesByLabel()["index-build"])
+	buf.Allocate(1 << 12)
+	require.Equal(t, int64(buf.curSz), BufferBytesByLabel()["index-build"])
+
+	other := NewBuffer(1<<10, "sort-scratch")
+	require.Equal(t, int64(1<<10), BufferBytesByLabel()["sort-scratch"])
+	require.NoError(t, other.Release())
+	require.NoError(t, buf.Release())
+
+	labels := BufferBytesByLabel()
+	require.NotContains(t, labels, "index-build")
+	require.NotContains(t, labels, "sort-scratch")
+}
+
+func TestBufferSpillAfter(t *testing.T) {
+	base := TotalBufferBytes()
+	hog := NewBuffer(1<<20, "test")
+	require.Equal(t, base+1<<20, TotalBufferBytes())
+
+	buf := NewBuffer(1<<10, "test").WithSpillAfter(base + 1<<21)
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.Write(make([]byte, 1<<19))
+	require.Equal(t, UseCalloc, buf.bufType)
+	require.False(t, buf.Stats().Spilled)
+
+	buf.Write(make([]byte, 1<<20))
+	require.Equal(t, UseMmap, buf.bufType)
+	require.True(t, buf.Stats().Spilled)
+	require.Equal(t, base+1<<21, buf.Stats().SpillThreshold)
+
+	// Renewing goes back to Calloc, deleting the tempfile.
+	path := buf.mmapFile.Fd.Name()
+	require.NoError(t, buf.Renew())
+	require.Equal(t, UseCalloc, buf.bufType)
+	require.False(t, buf.Stats().Spilled)
+	_, err := os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+	buf.Write(make([]byte, 1<<19))
+	require.Equal(t, UseCalloc, buf.bufType)
+
+	require.NoError(t, hog.Release())
+	require.Equal(t, base+int64(buf.curSz), TotalBufferBytes())
+}
+
+func TestBufferReadFramedFrom(t *testing.T) {
+	src := NewBuffer(64, "test")
+	defer func() { require.NoError(t, src.Release()) }()
+	for i := 0; i < 100; i++ {
+		src.WriteSlice(bytes.Repeat([]byte{byte(i)}, i))
+	}
+
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			// OneByteReader makes sure prefixes and slices get split across reads.
+			n, err := buf.ReadFramedFrom(iotest.OneByteReader(bytes.NewReader(src.Bytes())))
+			require.NoError(t, err)
+			require.Equal(t, 100, n)
+			require.Equal(t, src.Bytes(), buf.Bytes())
+
+			buf.Reset()
+			truncated := src.Bytes()[:src.LenNoPadding()-10]
+			n, err = buf.ReadFramedFrom(bytes.NewReader(truncated))
+			require.Equal(t, io.ErrUnexpectedEOF, err)
+			require.Equal(t, 99, n)
+			require.Equal(t, src.Bytes()[:buf.LenNoPadding()], buf.Bytes())
+		})
+	}
+
+	// Timestamped slices keep their timestamps.
+	stamped := NewBuffer(64, "test").WithTimestamps()
+	defer func() { require.NoError(t, stamped.Release()) }()
+	copy(stamped.SliceAllocate(3), "abc")
+	stamped.SliceAllocate(0)
+	out := NewBuffer(64, "test").WithTimestamps()
+	defer func() { require.NoError(t, out.Release()) }()
+	n, err := out.ReadFramedFrom(iotest.OneByteReader(bytes.NewReader(stamped.Bytes())))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, stamped.Bytes(), out.Bytes())
+	slice, _ := out.Slice(out.StartOffset())
+	want, _ := stamped.Slice(stamped.StartOffset())
+	ts, payload := SplitTimestamp(slice)
+	wantTs, _ := SplitTimestamp(want)
+	require.Equal(t, wantTs, ts)
+	require.Equal(t, []byte("abc"), payload)
+
+	// A frame too small for a timestamp is rejected.
+	out.Reset()
+	bare := NewBuffer(64, "test")
+	defer func() { require.NoError(t, bare.Release()) }()
+	bare.WriteSlice([]byte("abc"))
+	_, err = out.ReadFramedFrom(bytes.NewReader(bare.Bytes()))
+	require.Error(t, err)
+	require.True(t, out.IsEmpty())
+}
+
+func TestBufferDetachSlice(t *testing.T) {
+	buf := NewBuffer(64, "test")
+	buf.WriteSlice([]byte("first"))
+	off := buf.LenWithPadding()
+	buf.WriteSlice([]byte("second"))
+
+	detached := buf.DetachSlice(off)
+	buf.Reset()
+	buf.WriteSlice([]byte("overwritten"))
+	require.NoError(t, buf.Release())
+	require.Equal(t, []byte("second"), detached)
+}
+
+func TestBufferMemoryGuard(t *testing.T) {
+	if _, err := systemAvailableMemory(); runtime.GOOS == "linux" {
+		require.NoError(t, err)
+	}
+
+	SetMemoryGuard(0.5, func() (uint64, error) { return 1 << 20, nil })
+	defer SetMemoryGuard(0, nil)
+
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+	_, err := buf.SliceAllocateE(1 << 18)
+	require.NoError(t, err)
+	_, err = buf.SliceAllocateE(1 << 19)
+	require.Error(t, err)
+	require.Panics(t, func() { buf.Grow(1 << 19) })
+}
+
+func TestBufferUpsert(t *testing.T) {
+	keyOf := func(slice []byte) []byte { return slice[:1] }
+	less := func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }
+
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			for _, kv := range []string{"c1", "a1", "b1", "a22", "c", "b3", "d1"} {
+				buf.Upsert([]byte(kv[:1]), []byte(kv), keyOf, less)
+			}
+			var got []string
+			require.NoError(t, buf.SliceIterate(func(slice []byte) error {
+				got = append(got, string(slice))
+				return nil
+			}))
+			require.Equal(t, []string{"a22", "b3", "c", "d1"}, got)
+		})
+	}
+}
+
+type recordingWriter struct {
+	writes [][]byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func TestBufferWriteToBySlices(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			for i := 0; i < 5; i++ {
+				buf.WriteSlice(bytes.Repeat([]byte{byte(i)}, i+1))
+			}
+			w := &recordingWriter{}
+			n, err := buf.WriteToBySlices(w, 2)
+			require.NoError(t, err)
+			require.Equal(t, int64(buf.LenNoPadding()), n)
+
+			// Every write must hold two whole records, 4+i+1 bytes each, except the last one.
+			var sizes []int
+			for _, p := range w.writes {
+				sizes = append(sizes, len(p))
+			}
+			require.Equal(t, []int{5 + 6, 7 + 8, 9}, sizes)
+			require.Equal(t, buf.Bytes(), bytes.Join(w.writes, nil))
+		})
+	}
+}
+
+func TestBufferLargeSizeHook(t *testing.T) {
+	for _, buf := range newTestBuffers(t, 64) {
+		t.Run(fmt.Sprintf("Using buffer type: %s", buf.bufType), func(t *testing.T) {
+			var fired []int
+			buf.WithLargeSizeHook(1<<20, func(_ *Buffer, n int) { fired = append(fired, n) })
+			buf.Allocate(512)
+			require.Empty(t, fired)
+			buf.Allocate(1 << 20)
+			buf.Allocate(1 << 22)
+			require.Equal(t, []int{1 << 20}, fired)
+		})
+	}
+}
+
+func TestBufferMmapGrowPageAligned(t *testing.T) {
+	buf, err := NewBufferTmp("", 64)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, buf.Release()) }()
+	buf.WithGrowStrategy(Exact)
+	for _, n := range []int{100, 5000, 12345} {
+		buf.Allocate(n)
+		require.Zero(t, buf.curSz%pageSize)
+		size, err := buf.FileSize()
+		require.NoError(t, err)
+		require.Zero(t, size%int64(pageSize))
+	}
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// SlicePointer returns a pointer into the slice written at offset, along with the offset of the
+// next slice, like Slice does. This gives zero-copy access to fixed-layout structs stored in the
+// buffer, by converting the pointer:
+//
+//	ptr, next := b.SlicePointer(offset, int(unsafe.Sizeof(T{})))
+//	t := (*T)(ptr)
+//
+// T must not contain any pointers, and the caller is responsible for the alignment of the slice
+// being suitable for T. The pointer is only valid until the next Grow. It panics if the slice is
+// shorter than size bytes, or empty.
+func (b *Buffer) SlicePointer(offset, size int) (unsafe.Pointer, int) {
+	slice, next := b.Slice(offset)
+	if len(slice) == 0 || len(slice) < size {
+		panic(bufferPanic{errors.Errorf(
+			"slice at offset %d has %d bytes, need %d", offset, len(slice), size)})
+	}
+	return unsafe.Pointer(&slice[0]), next
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package z
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferSlicePointer(t *testing.T) {
+	type record struct {
+		Key   uint64
+		Value uint32
+		Flags uint32
+	}
+	sz := int(unsafe.Sizeof(record{}))
+	buf := NewBuffer(64, "test")
+	defer func() { require.NoError(t, buf.Release()) }()
+
+	for i := 0; i < 100; i++ {
+		// An empty slice in front keeps the payload of each record 8-byte aligned.
+		buf.SliceAllocate(0)
+		off := buf.LenWithPadding()
+		buf.SliceAllocate(sz)
+		ptr, _ := buf.SlicePointer(off, sz)
+		require.Zero(t, uintptr(ptr)%8)
+		rec := (*record)(ptr)
+		rec.Key, rec.Value, rec.Flags = uint64(i), uint32(i*2), 1
+	}
+
+	var count int
+	for next := buf.StartOffset(); next >= 0; {
+		_, next = buf.Slice(next)
+		var ptr unsafe.Pointer
+		ptr, next = buf.SlicePointer(next, sz)
+		require.Equal(t, record{uint64(count), uint32(count * 2), 1}, *(*record)(ptr))
+		count++
+	}
+	require.Equal(t, 100, count)
+	require.Panics(t, func() { buf.SlicePointer(buf.StartOffset(), sz) })
+}
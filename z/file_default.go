@@ -18,7 +18,10 @@
 
 package z
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+)
 
 // Truncate would truncate the mmapped file to the given size. On Linux, we truncate
 // the underlying file and then call mremap, but on other systems, we unmap first,
@@ -37,3 +40,13 @@ func (m *MmapFile) Truncate(maxSz int64) error {
 	m.Data, err = Mmap(m.Fd, true, maxSz) // Mmap up to max size.
 	return err
 }
+
+// diskUsage returns the size of the file. Sparse allocation is not accounted for on this platform.
+func diskUsage(fi os.FileInfo) int64 {
+	return fi.Size()
+}
+
+// residentBytes is not supported on this platform.
+func residentBytes(b []byte) (int64, error) {
+	return 0, fmt.Errorf("mincore is not supported on this platform")
+}
@@ -18,6 +18,11 @@ package z
 
 import (
 	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 // Truncate would truncate the mmapped file to the given size. On Linux, we truncate
@@ -35,3 +40,34 @@ func (m *MmapFile) Truncate(maxSz int64) error {
 	m.Data, err = mremap(m.Data, int(maxSz)) // Mmap up to max size.
 	return err
 }
+
+// diskUsage returns the number of bytes actually allocated on disk for the file, which can be
+// smaller than its size for sparse files.
+func diskUsage(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return fi.Size()
+}
+
+// residentBytes returns the number of bytes of the mmapped region b which are resident in memory,
+// as reported by mincore.
+func residentBytes(b []byte) (int64, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	pageSize := os.Getpagesize()
+	vec := make([]byte, (len(b)+pageSize-1)/pageSize)
+	_, _, errno := unix.Syscall(unix.SYS_MINCORE, uintptr(unsafe.Pointer(&b[0])),
+		uintptr(len(b)), uintptr(unsafe.Pointer(&vec[0])))
+	if errno != 0 {
+		return 0, errno
+	}
+	var resident int64
+	for _, v := range vec {
+		if v&1 == 1 {
+			resident += int64(pageSize)
+		}
+	}
+	return resident, nil
+}
@@ -38,6 +38,20 @@ func Madvise(b []byte, readahead bool) error {
 	return madvise(b, readahead)
 }
 
+// MadviseAdvice is a hint to the kernel about how a memory-mapped region is going to be accessed.
+type MadviseAdvice int
+
+const (
+	// AdviseNormal restores the default readahead behavior.
+	AdviseNormal MadviseAdvice = iota
+	// AdviseSequential expects pages to be accessed in order, allowing aggressive readahead.
+	AdviseSequential
+	// AdviseRandom expects pages to be accessed in random order, disabling readahead.
+	AdviseRandom
+	// AdviseWillNeed expects the pages to be accessed soon, reading them in ahead of time.
+	AdviseWillNeed
+)
+
 // Msync would call sync on the mmapped data.
 func Msync(b []byte) error {
 	return msync(b)
@@ -54,6 +54,25 @@ func madvise(b []byte, readahead bool) error {
 	return nil
 }
 
+// advise uses the madvise system call to pass the given advice about the use of memory.
+func advise(b []byte, advice MadviseAdvice) error {
+	flag := unix.MADV_NORMAL
+	switch advice {
+	case AdviseSequential:
+		flag = unix.MADV_SEQUENTIAL
+	case AdviseRandom:
+		flag = unix.MADV_RANDOM
+	case AdviseWillNeed:
+		flag = unix.MADV_WILLNEED
+	}
+	_, _, e1 := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])),
+		uintptr(len(b)), uintptr(flag))
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
 func msync(b []byte) error {
 	return unix.Msync(b, unix.MS_SYNC)
 }
@@ -39,6 +39,11 @@ func madvise(b []byte, readahead bool) error {
 	return syscall.EPLAN9
 }
 
+// advise is a no-op, since the advice is only a hint.
+func advise(b []byte, advice MadviseAdvice) error {
+	return nil
+}
+
 func msync(b []byte) error {
 	return syscall.EPLAN9
 }
@@ -50,6 +50,24 @@ func madvise(b []byte, readahead bool) error {
 	return unix.Madvise(b, flags)
 }
 
+// advise uses the madvise system call to pass the given advice about the use of memory.
+func advise(b []byte, advice MadviseAdvice) error {
+	return unix.Madvise(b, madviseFlag(advice))
+}
+
+func madviseFlag(advice MadviseAdvice) int {
+	switch advice {
+	case AdviseSequential:
+		return unix.MADV_SEQUENTIAL
+	case AdviseRandom:
+		return unix.MADV_RANDOM
+	case AdviseWillNeed:
+		return unix.MADV_WILLNEED
+	default:
+		return unix.MADV_NORMAL
+	}
+}
+
 func msync(b []byte) error {
 	return unix.Msync(b, unix.MS_SYNC)
 }
@@ -90,6 +90,11 @@ func madvise(b []byte, readahead bool) error {
 	return nil
 }
 
+func advise(b []byte, advice MadviseAdvice) error {
+	// Do Nothing. There is no madvise on Windows.
+	return nil
+}
+
 func msync(b []byte) error {
 	return syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
 }
@@ -19,6 +19,7 @@ package z
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/cespare/xxhash/v2"
 )
@@ -60,6 +61,8 @@ func KeyToHash(key interface{}) (uint64, uint64) {
 var (
 	dummyCloserChan <-chan struct{}
 	tmpDir          string
+	mmapDirs        []string
+	mmapDirIdx      uint32
 )
 
 // Closer holds the two things we need to close a goroutine and wait for it to
@@ -77,6 +80,23 @@ func SetTmpDir(dir string) {
 	tmpDir = dir
 }
 
+// SetMmapDirs sets the directories for the temporary buffers, overriding SetTmpDir. The buffers
+// are spread across these directories in a round-robin fashion, which avoids contention on a
+// single directory, and balances the load across multiple disks. It must be called before any
+// temporary buffers are created.
+func SetMmapDirs(dirs []string) {
+	mmapDirs = dirs
+}
+
+// nextTmpDir returns the directory to create the next temporary buffer in.
+func nextTmpDir() string {
+	if len(mmapDirs) == 0 {
+		return tmpDir
+	}
+	idx := atomic.AddUint32(&mmapDirIdx, 1)
+	return mmapDirs[int(idx%uint32(len(mmapDirs)))]
+}
+
 // NewCloser constructs a new Closer, with an initial count on the WaitGroup.
 func NewCloser(initial int) *Closer {
 	ret := &Closer{}